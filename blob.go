@@ -0,0 +1,57 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "strings"
+    "time"
+)
+
+// uploadsPrefix is where uploads are kept while they are validated, before
+// they are stored under their final key.
+const uploadsPrefix = "uploads/"
+
+// isPrivatePath reports whether the file at p, which may have a leading
+// slash, must not be publicly readable.
+func isPrivatePath(p string) bool {
+    return strings.HasPrefix(strings.TrimPrefix(p, "/"), uploadsPrefix)
+}
+
+// BlobStore holds uploaded image files. Paths are slash separated and
+// relative to the root of the store, e.g. "groups/1/gifs/funny.gif". Files
+// are publicly readable at their URL, except for those under uploadsPrefix.
+type BlobStore interface {
+    Put(path string, data []byte, contentType string) error
+    // Writer streams a file to path. Nothing is stored until Close
+    // succeeds, and Abort discards whatever was written.
+    Writer(path string, contentType string) (BlobWriter, error)
+    Copy(from, to string) error
+    Get(path string) ([]byte, error)
+    Reader(path string) (io.ReadCloser, error)
+    Exists(path string) (bool, error)
+    Delete(path string) error
+    // DeletePrefix removes every file whose path starts with prefix.
+    DeletePrefix(prefix string) error
+    URL(path string) string
+    // SignedPutURL returns a URL that lets anyone holding it upload the file
+    // at path until expires, along with the headers they must send.
+    SignedPutURL(path, contentType string, expires time.Time) (string, map[string]string, error)
+}
+
+type BlobWriter interface {
+    io.Writer
+    Close() error
+    Abort() error
+}
+
+// NewBlobStore returns the blob store for the configured backend. An empty
+// backend defaults to S3.
+func NewBlobStore(backend string) (BlobStore, error) {
+    switch backend {
+    case "", "s3":
+        return NewS3BlobStore(envOr("S3_BUCKET", "cc-gifgroup-api"))
+    case "local":
+        return NewLocalBlobStore(envOr("BLOB_DIR", "blobs"), envOr("BLOB_URL", "http://localhost"+envOr("API_PORT", ":1323")+localBlobRoute))
+    }
+    return nil, fmt.Errorf("unknown blob store backend %q", backend)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+    "archive/zip"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "path"
+    "strings"
+    "time"
+)
+
+const (
+    BulkCreated   = "created"
+    BulkDuplicate = "duplicate"
+    BulkRejected  = "rejected"
+    BulkFailed    = "failed"
+)
+
+// ArchiveLimits bounds the ZIP archives accepted by ReadArchive. Each file
+// inside is also held to uploadLimits.
+type ArchiveLimits struct {
+    MaxBytes int
+    MaxFiles int
+}
+
+var archiveLimits = ArchiveLimits{MaxBytes: 256 << 20, MaxFiles: 100}
+
+// maxArchiveFormOverhead allows for the other fields and the part headers of
+// a form carrying an archive.
+const maxArchiveFormOverhead = 1 << 20
+
+// BulkResult reports what became of one file of a bulk upload.
+type BulkResult struct {
+    Filename  string   `json:"filename"`
+    Status    string   `json:"status"` // BulkCreated, BulkDuplicate, BulkRejected or BulkFailed
+    Gif       *Gif     `json:"gif,omitempty"`
+    Warnings  []string `json:"warnings,omitempty"`
+    ErrorCode int      `json:"error_code,omitempty"`
+    ErrorText string   `json:"error_text,omitempty"`
+}
+
+// ReadArchive opens the ZIP archive sent in the named multipart form field
+// and returns the files in it, leaving out directories and the metadata
+// that archivers add, such as __MACOSX folders and dot files.
+func ReadArchive(req *http.Request, field string) ([]*zip.File, error) {
+    // The form is spooled to disk as it is parsed, so stop reading once the
+    // body is larger than any acceptable archive could make it.
+    limit := int64(archiveLimits.MaxBytes) + maxArchiveFormOverhead
+    if req.ContentLength > limit {
+        return nil, archiveTooLargeError()
+    }
+    counter := &byteCounter{}
+    req.Body = ioutil.NopCloser(io.TeeReader(http.MaxBytesReader(nil, req.Body, limit), counter))
+
+    err := req.ParseMultipartForm(16 << 20)
+    if int64(counter.n) >= limit {
+        return nil, archiveTooLargeError()
+    }
+    if err != nil {
+        return nil, NewBadRequestError(ErrCodeInvalidForm, "Invalid or missing archive", err)
+    }
+
+    archive, header, err := req.FormFile(field)
+    if err != nil {
+        return nil, NewBadRequestError(ErrCodeInvalidForm, "Invalid or missing archive", err)
+    }
+    defer archive.Close()
+
+    if header.Size > int64(archiveLimits.MaxBytes) {
+        return nil, archiveTooLargeError()
+    }
+
+    reader, err := zip.NewReader(archive, header.Size)
+    if err != nil {
+        return nil, NewBadRequestError(ErrCodeInvalidForm, "Archive is not a valid ZIP file", err)
+    }
+
+    files := []*zip.File{}
+    for _, file := range reader.File {
+        name := path.Base(file.Name)
+        if file.FileInfo().IsDir() || strings.HasPrefix(name, ".") || strings.HasPrefix(file.Name, "__MACOSX/") {
+            continue
+        }
+        files = append(files, file)
+    }
+
+    if len(files) > archiveLimits.MaxFiles {
+        return nil, NewAppError(http.StatusRequestEntityTooLarge, ErrCodeTooLarge,
+            fmt.Sprintf("Archive holds more than %v files", archiveLimits.MaxFiles), nil)
+    }
+    return files, nil
+}
+
+func archiveTooLargeError() error {
+    return NewAppError(http.StatusRequestEntityTooLarge, ErrCodeTooLarge,
+        fmt.Sprintf("Archive is larger than %v bytes", archiveLimits.MaxBytes), nil)
+}
+
+// GroupGifs holds the gifs of a group, read from the store once for all the
+// files of an archive rather than for each, and added to as files are
+// created from it. Duplicates are looked for among them.
+type GroupGifs struct {
+    Gifs   Gifs
+    hashes map[string]bool // by Sha256
+}
+
+// LoadGroupGifs reads the gifs of the group.
+func LoadGroupGifs(groupId int) (*GroupGifs, error) {
+    gifs, err := AllGroupGifs(groupId)
+    if err != nil {
+        return nil, err
+    }
+
+    known := &GroupGifs{}
+    for i := range gifs {
+        known.Add(&gifs[i])
+    }
+    return known, nil
+}
+
+// Add records gif as one of the group's.
+func (k *GroupGifs) Add(gif *Gif) {
+    if k.hashes == nil {
+        k.hashes = make(map[string]bool)
+    }
+    k.Gifs = append(k.Gifs, *gif)
+    if len(gif.Sha256) > 0 {
+        k.hashes[gif.Sha256] = true
+    }
+}
+
+// SaveArchivedGif adds the archived file to group, whose gifs are known, as a
+// new gif uploaded by ownerId. Problems with the file itself are reported in
+// the result, so the rest of the archive can still be processed. Server
+// errors are returned, as well as reported as BulkFailed in the result. If
+// skipIdentical is set, files identical to a known gif are skipped as
+// duplicates whatever duplicatePolicy says.
+func SaveArchivedGif(group *Group, known *GroupGifs, ownerId int, file *zip.File, filename string, createdAt time.Time, skipIdentical bool) (BulkResult, error) {
+    result := BulkResult{Filename: file.Name}
+
+    content, err := readArchived(file)
+    if err == nil && skipIdentical && known.hashes[ContentHash(content)] {
+        err = NewAppError(http.StatusConflict, ErrCodeDuplicate, "Gif is identical to one already in this group", nil)
+    }
+    if err == nil {
+        result.Gif, result.Warnings, err = saveArchivedGif(group, known, ownerId, content, filename, createdAt)
+    }
+    if err == nil {
+        known.Add(result.Gif)
+    }
+
+    appErr, ok := err.(*AppError)
+    switch {
+    case err == nil:
+        result.Status = BulkCreated
+    case ok && appErr.Code == ErrCodeDuplicate:
+        result.Status = BulkDuplicate
+    case ok && appErr.Status < http.StatusInternalServerError:
+        result.Status = BulkRejected
+    default:
+        result.Status = BulkFailed
+    }
+
+    if err != nil {
+        appErr = AsAppError(err)
+        result.ErrorCode = appErr.Code
+        result.ErrorText = appErr.Message
+    }
+    if result.Status == BulkFailed {
+        return result, err
+    }
+    return result, nil
+}
+
+func saveArchivedGif(group *Group, known *GroupGifs, ownerId int, content []byte, filename string, createdAt time.Time) (*Gif, []string, error) {
+    upload, err := NewUpload(content, filename)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    gifId, err := store.NextGifId()
+    if err != nil {
+        return nil, nil, err
+    }
+
+    gif := &Gif{}
+    gif.Id = gifId
+    gif.GroupId = group.Id
+    gif.OwnerId = ownerId
+    gif.CreatedAt = createdAt
+
+    warnings, err := SaveGifUploadAmong(gif, upload, known.Gifs)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    err = store.SaveGif(gif)
+    if err != nil {
+        ReleaseObject(gif.ImageKey)
+        return nil, nil, err
+    }
+    return gif, warnings, nil
+}
+
+// readArchived decompresses file, stopping at uploadLimits.MaxBytes whatever
+// size the archive claims, so a crafted archive can't exhaust memory.
+func readArchived(file *zip.File) ([]byte, error) {
+    if file.UncompressedSize64 > uint64(uploadLimits.MaxBytes) {
+        return nil, tooLargeError()
+    }
+
+    reader, err := file.Open()
+    if err != nil {
+        return nil, NewBadRequestError(ErrCodeInvalidForm, "File is corrupt in the archive", err)
+    }
+    defer reader.Close()
+
+    content, err := ioutil.ReadAll(io.LimitReader(reader, int64(uploadLimits.MaxBytes)+1))
+    if err != nil {
+        return nil, NewBadRequestError(ErrCodeInvalidForm, "File is corrupt in the archive", err)
+    }
+    if len(content) > uploadLimits.MaxBytes {
+        return nil, tooLargeError()
+    }
+    return content, nil
+}
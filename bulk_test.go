@@ -0,0 +1,138 @@
+package main
+
+import (
+    "bytes"
+    "image/color"
+    "mime/multipart"
+    "net/http"
+    "strconv"
+    "sync/atomic"
+    "testing"
+
+    "github.com/labstack/echo"
+)
+
+// postArchive sends archive in the archive field of a form to path, as serve
+// does.
+func postArchive(t *testing.T, e *echo.Echo, apiKey, path string, archive []byte, content interface{}) int {
+    var body bytes.Buffer
+    w := multipart.NewWriter(&body)
+    part, err := w.CreateFormFile("archive", "gifs.zip")
+    if err == nil {
+        _, err = part.Write(archive)
+    }
+    if err == nil {
+        err = w.Close()
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    req, err := http.NewRequest("POST", path, &body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("Content-Type", w.FormDataContentType())
+    return serve(t, e, req, apiKey, content)
+}
+
+// bulkServerError fails to store the second of three files, and checks that
+// the report still covers the first, so that sending the archive again
+// creates the rest.
+func bulkServerError(t *testing.T, s GroupStore) {
+    e, apiKey := testServer(t, s)
+    groupId, err := postForm(e, apiKey, "/api/v1/groups", map[string]string{"name": "bulk"}, testGif(t, color.White))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    names := []string{"red.gif", "green.gif", "blue.gif"}
+    archive := zipArchive(t, names, map[string]string{
+        "red.gif":   string(testGif(t, color.RGBA{255, 0, 0, 255})),
+        "green.gif": string(testGif(t, color.RGBA{0, 255, 0, 255})),
+        "blue.gif":  string(testGif(t, color.RGBA{0, 0, 255, 255})),
+    })
+
+    path := "/api/v1/groups/" + strconv.Itoa(groupId) + "/gifs/bulk"
+    working := blobs
+    blobs = &failPosters{BlobStore: working, after: 1}
+    var results []BulkResult
+    code := postArchive(t, e, apiKey, path, archive, &results)
+    blobs = working
+
+    if code != http.StatusInternalServerError || len(results) != 2 {
+        t.Fatalf("got %v with %v results, want %v with 2", code, len(results), http.StatusInternalServerError)
+    }
+    if results[0].Status != BulkCreated || results[1].Status != BulkFailed || results[1].ErrorCode == 0 {
+        t.Errorf("got results %+v, want red created and green failed", results)
+    }
+
+    results = nil
+    code = postArchive(t, e, apiKey, path, archive, &results)
+    if code != http.StatusOK || len(results) != 3 {
+        t.Fatalf("retry got %v with %v results, want %v with 3", code, len(results), http.StatusOK)
+    }
+    for i, want := range []string{BulkDuplicate, BulkCreated, BulkCreated} {
+        if results[i].Status != want {
+            t.Errorf("retry of %v was %v, want %v", names[i], results[i].Status, want)
+        }
+    }
+}
+
+func TestBulkServerErrorMemory(t *testing.T) {
+    bulkServerError(t, NewMemoryStore())
+}
+
+func TestBulkServerErrorRedis(t *testing.T) {
+    bulkServerError(t, testRedisStore(t))
+}
+
+// countGroupGifs counts the pages of group gifs read from the store.
+type countGroupGifs struct {
+    GroupStore
+    reads int32
+}
+
+func (s *countGroupGifs) FindGroupGifs(groupId int, q ListQuery) (Gifs, Page, error) {
+    atomic.AddInt32(&s.reads, 1)
+    return s.GroupStore.FindGroupGifs(groupId, q)
+}
+
+// bulkReadsGroupOnce checks that the gifs of the group are read once for a
+// whole archive, and that files are still checked against those created
+// before them from it.
+func bulkReadsGroupOnce(t *testing.T, s GroupStore) {
+    counting := &countGroupGifs{GroupStore: s}
+    e, apiKey := testServer(t, counting)
+    groupId, err := postForm(e, apiKey, "/api/v1/groups", map[string]string{"name": "bulk"}, testGif(t, color.White))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Images of one flat colour look alike whatever the colour.
+    names := []string{"red.gif", "green.gif", "blue.gif"}
+    archive := zipArchive(t, names, map[string]string{
+        "red.gif":   string(testGif(t, color.RGBA{255, 0, 0, 255})),
+        "green.gif": string(testGif(t, color.RGBA{0, 255, 0, 255})),
+        "blue.gif":  string(testGif(t, color.RGBA{0, 0, 255, 255})),
+    })
+    var results []BulkResult
+    code := postArchive(t, e, apiKey, "/api/v1/groups/"+strconv.Itoa(groupId)+"/gifs/bulk", archive, &results)
+    if code != http.StatusOK || len(results) != 3 {
+        t.Fatalf("got %v with %v results, want %v with 3", code, len(results), http.StatusOK)
+    }
+    if results[0].Status != BulkCreated || len(results[0].Warnings) > 0 || len(results[2].Warnings) == 0 {
+        t.Errorf("got results %+v, want red created without warnings and blue warned of red and green", results)
+    }
+    if reads := atomic.LoadInt32(&counting.reads); reads != 1 {
+        t.Errorf("read the group's gifs %v times, want once", reads)
+    }
+}
+
+func TestBulkReadsGroupOnceMemory(t *testing.T) {
+    bulkReadsGroupOnce(t, NewMemoryStore())
+}
+
+func TestBulkReadsGroupOnceRedis(t *testing.T) {
+    bulkReadsGroupOnce(t, testRedisStore(t))
+}
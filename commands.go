@@ -0,0 +1,64 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strconv"
+)
+
+// RunCommand runs a one-shot maintenance command instead of the API server,
+// e.g. `cc-gifgroup-api migrate`.
+func RunCommand(args []string) {
+    switch args[0] {
+    case "migrate":
+        Migrate()
+    case "set-role":
+        SetRole(args[1:])
+    default:
+        fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+        os.Exit(2)
+    }
+}
+
+// Migrate upgrades existing data in the configured store to the current
+// layout, e.g. building the group index from group:{id} keys in Redis.
+func Migrate() {
+    migrator, ok := store.(Migrator)
+    if !ok {
+        fmt.Println("Nothing to migrate")
+        return
+    }
+
+    if err := migrator.Migrate(); err != nil {
+        fmt.Fprintln(os.Stderr, "Migration failed:", err)
+        os.Exit(1)
+    }
+    fmt.Println("Migration complete")
+}
+
+// SetRole gives a user a role, e.g. `cc-gifgroup-api set-role 1 admin`. It is
+// how the first admin is made; after that admins can change roles through
+// the API.
+func SetRole(args []string) {
+    if len(args) != 2 {
+        fmt.Fprintln(os.Stderr, "usage: set-role {user_id} {player|moderator|admin}")
+        os.Exit(2)
+    }
+
+    id, err := strconv.Atoi(args[0])
+    if err != nil || !ValidRole(args[1]) {
+        fmt.Fprintln(os.Stderr, "usage: set-role {user_id} {player|moderator|admin}")
+        os.Exit(2)
+    }
+
+    user, err := store.FindUser(id)
+    if err == nil {
+        user.Role = args[1]
+        err = store.SaveUser(user)
+    }
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "Setting role failed:", err)
+        os.Exit(1)
+    }
+    fmt.Printf("User %v now has the %v role\n", user.Id, user.Role)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+    "encoding/json"
+    "testing"
+    "time"
+)
+
+// migrateGroups runs the migrate command twice over groups saved out of
+// creation order and, in Redis, over a group and gif saved before the
+// indexes existed, and checks that every group is listed by creation time.
+func migrateGroups(t *testing.T, s GroupStore) {
+    testServer(t, s)
+
+    now := time.Now().UTC()
+    for _, group := range []Group{
+        {Id: 1, Name: "newest", CreatedAt: now},
+        {Id: 2, Name: "oldest", CreatedAt: now.Add(-2 * time.Hour)},
+    } {
+        if err := store.SaveGroup(&group); err != nil {
+            t.Fatal(err)
+        }
+    }
+    want := []string{"oldest", "newest"}
+
+    if r, ok := s.(*RedisStore); ok {
+        group, _ := json.Marshal(Group{Id: 3, Name: "legacy", CreatedAt: now.Add(-time.Hour)})
+        gif, _ := json.Marshal(Gif{Id: 1, GroupId: 3, CreatedAt: now})
+        rC := r.pool.Get()
+        rC.Send("SET", "group:3", group)
+        rC.Send("SET", "gif:1", gif)
+        rC.Send("SADD", "gifsForGroup:3", "gif:1")
+        _, err := rC.Do("")
+        rC.Close()
+        if err != nil {
+            t.Fatal(err)
+        }
+        want = []string{"oldest", "legacy", "newest"}
+    }
+
+    for run := 1; run <= 2; run++ {
+        Migrate()
+
+        groups, _, err := store.FindAllGroups(ListQuery{Limit: 10, Sort: SortByCreated})
+        if err != nil {
+            t.Fatal(err)
+        }
+        var names []string
+        for _, group := range groups {
+            names = append(names, group.Name)
+        }
+        if len(names) != len(want) {
+            t.Fatalf("run %v listed %v, want %v", run, names, want)
+        }
+        for i := range want {
+            if names[i] != want[i] {
+                t.Errorf("run %v listed %v, want %v", run, names, want)
+                break
+            }
+        }
+    }
+
+    if _, ok := s.(*RedisStore); ok {
+        gifs, _, err := store.FindGroupGifs(3, ListQuery{Limit: 10, Sort: SortById})
+        if err != nil || len(gifs) != 1 {
+            t.Errorf("legacy group lists %v gifs, error %v, want 1", len(gifs), err)
+        }
+        leaders, err := store.FindGroupLeaderboard(3, 10)
+        if err != nil || len(leaders) != 1 {
+            t.Errorf("legacy group's leaderboard holds %v gifs, error %v, want 1", len(leaders), err)
+        }
+    }
+}
+
+func TestMigrateGroupsMemory(t *testing.T) {
+    migrateGroups(t, NewMemoryStore())
+}
+
+func TestMigrateGroupsRedis(t *testing.T) {
+    migrateGroups(t, testRedisStore(t))
+}
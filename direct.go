@@ -0,0 +1,102 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "net/http"
+    "path"
+    "time"
+)
+
+// uploadUrlTTL is how long a direct upload URL can be used for.
+var uploadUrlTTL = 15 * time.Minute
+
+// pendingUploadGrace is how much longer than its URL a pending upload is
+// kept, so that a client which finishes uploading just before the URL expires
+// still has time to complete it.
+const pendingUploadGrace = time.Hour
+
+// PendingUpload is a direct upload that has been issued but not completed:
+// the client PUTs the gif to UploadUrl, sending Headers, then completes the
+// upload to create the gif.
+type PendingUpload struct {
+    Id        string            `json:"id"`
+    GroupId   int               `json:"group_id"`
+    UserId    int               `json:"user_id"` // who may complete it
+    Filename  string            `json:"filename"`
+    UploadUrl string            `json:"upload_url"`
+    Method    string            `json:"method"`
+    Headers   map[string]string `json:"headers"`
+    ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// Path returns where the client uploads the gif in blob storage. It sits with
+// streamed uploads, as it is only kept until the upload is completed.
+func (u *PendingUpload) Path() string {
+    return uploadsPrefix + u.Id + ".gif"
+}
+
+// NewPendingUpload issues a signed URL for the user to upload a gif to the
+// group, and saves the pending upload so it can be completed later.
+func NewPendingUpload(groupId, userId int, filename string) (*PendingUpload, error) {
+    b := make([]byte, 16)
+    _, err := rand.Read(b)
+    if err != nil {
+        return nil, NewInternalError(ErrCodeInternal, "Error starting upload", err)
+    }
+
+    filename = path.Base(filename)
+    if filename == "." || filename == "/" {
+        filename = "upload.gif"
+    }
+    u := &PendingUpload{
+        Id:        hex.EncodeToString(b),
+        GroupId:   groupId,
+        UserId:    userId,
+        Filename:  filename,
+        Method:    http.MethodPut,
+        ExpiresAt: time.Now().UTC().Add(uploadUrlTTL).Truncate(time.Second),
+    }
+
+    u.UploadUrl, u.Headers, err = blobs.SignedPutURL(u.Path(), GifContentType, u.ExpiresAt)
+    if err != nil {
+        return nil, err
+    }
+
+    err = store.SavePendingUpload(u, uploadUrlTTL+pendingUploadGrace)
+    if err != nil {
+        return nil, err
+    }
+    return u, nil
+}
+
+// NewStoredUpload validates the gif a client uploaded for u, reading it back
+// from blob storage. The client can keep uploading to its URL until it
+// expires, so the gif is validated as it is copied to a temporary path of
+// the server's own, which is what gets stored. An invalid gif is deleted, so
+// the client can upload again while the URL lasts. The caller must Discard
+// the upload once done with it.
+func NewStoredUpload(u *PendingUpload) (*Upload, error) {
+    exists, err := blobs.Exists(u.Path())
+    if err != nil {
+        return nil, err
+    }
+    if !exists {
+        return nil, NewAppError(http.StatusConflict, ErrCodeNotUploaded, "Gif has not been uploaded yet", nil)
+    }
+
+    r, err := blobs.Reader(u.Path())
+    if err != nil {
+        return nil, err
+    }
+    defer r.Close()
+
+    upload, err := storeTemp(r)
+    if err != nil {
+        blobs.Delete(u.Path())
+        return nil, err
+    }
+
+    upload.Filename = u.Filename
+    return upload, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "bytes"
+    "image/color"
+    "net/http"
+    "strconv"
+    "testing"
+    "time"
+
+    "github.com/labstack/echo"
+)
+
+// putUpload PUTs content to the upload URL of u, as a client would.
+func putUpload(t *testing.T, e *echo.Echo, u *PendingUpload, content []byte) int {
+    req, err := http.NewRequest(u.Method, u.UploadUrl, bytes.NewReader(content))
+    if err != nil {
+        t.Fatal(err)
+    }
+    for name, value := range u.Headers {
+        req.Header.Set(name, value)
+    }
+    return serve(t, e, req, "", nil)
+}
+
+// directUpload issues a direct upload, sends the gif to its URL and completes
+// it, and checks that an upload can only be completed once it has been sent,
+// and only once, and that an expired URL is refused.
+func directUpload(t *testing.T, s GroupStore) {
+    e, apiKey := testServer(t, s)
+    groupId, err := postForm(e, apiKey, "/api/v1/groups", map[string]string{"name": "group"}, testGif(t, color.White))
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := "/api/v1/groups/" + strconv.Itoa(groupId) + "/gifs"
+
+    var u PendingUpload
+    if code := sendForm(t, e, "POST", apiKey, path+"/uploads", map[string]string{"filename": "cat.gif"}, nil, &u); code != http.StatusOK {
+        t.Fatalf("issuing got %v", code)
+    }
+    complete := path + "/uploads/" + u.Id + "/complete"
+    if code := sendForm(t, e, "POST", apiKey, complete, nil, nil, nil); code != http.StatusConflict {
+        t.Errorf("completing before uploading got %v, want %v", code, http.StatusConflict)
+    }
+
+    content := testGif(t, color.White)
+    if code := putUpload(t, e, &u, content); code != http.StatusOK {
+        t.Fatalf("uploading got %v", code)
+    }
+    var gif Gif
+    if code := sendForm(t, e, "POST", apiKey, complete, nil, nil, &gif); code != http.StatusOK {
+        t.Fatalf("completing got %v", code)
+    }
+    if gif.Filename != "cat.gif" || gif.Sha256 != ContentHash(content) {
+        t.Errorf("got gif %q with hash %v, want cat.gif with %v", gif.Filename, gif.Sha256, ContentHash(content))
+    }
+    if code := sendForm(t, e, "POST", apiKey, complete, nil, nil, nil); code != http.StatusNotFound {
+        t.Errorf("completing twice got %v, want %v", code, http.StatusNotFound)
+    }
+    var gifs Gifs
+    if code := getJSON(t, e, "", path, &gifs); code != http.StatusOK || len(gifs) != 1 {
+        t.Errorf("got %v and %v gifs, want 1", code, len(gifs))
+    }
+
+    previous := uploadUrlTTL
+    uploadUrlTTL = -time.Minute
+    defer func() { uploadUrlTTL = previous }()
+    if code := sendForm(t, e, "POST", apiKey, path+"/uploads", nil, nil, &u); code != http.StatusOK {
+        t.Fatalf("issuing got %v", code)
+    }
+    if code := putUpload(t, e, &u, content); code != http.StatusForbidden {
+        t.Errorf("uploading to an expired URL got %v, want %v", code, http.StatusForbidden)
+    }
+    if code := sendForm(t, e, "POST", apiKey, path+"/uploads/"+u.Id+"/complete", nil, nil, nil); code != http.StatusConflict {
+        t.Errorf("completing an expired upload got %v, want %v", code, http.StatusConflict)
+    }
+}
+
+func TestDirectUploadMemory(t *testing.T) {
+    directUpload(t, NewMemoryStore())
+}
+
+func TestDirectUploadRedis(t *testing.T) {
+    directUpload(t, testRedisStore(t))
+}
@@ -1,29 +1,130 @@
 package main
 
-import "net/http"
+import (
+    "log"
+    "net/http"
 
-func SetInternalServerError(res *ResponseTemplate, errorCode int, errorText string) {
-    /* Error Codes: 
-        1 - Redis Error saving groups/gifs
-        2 - S3 Error uploading group image
-        3 - Redis Error finding groups/gifs
-    */
+    "github.com/labstack/echo"
+)
 
-    res.Success = false
-    res.StatusCode = http.StatusInternalServerError
-    res.StatusText = http.StatusText(http.StatusInternalServerError)
-    res.ErrorCode = errorCode 
-    res.ErrorText = errorText
+// Error codes reported in ResponseTemplate.ErrorCode
+const (
+    ErrCodeSave         = 1  // Store error saving groups/gifs
+    ErrCodeBlob         = 2  // Blob storage error uploading, reading or deleting images
+    ErrCodeFind         = 3  // Store error finding groups/gifs
+    ErrCodeInvalidForm  = 4  // Invalid form (missing image or other)
+    ErrCodeUnavailable  = 5  // Store unavailable
+    ErrCodeCorrupt      = 6  // Stored record could not be decoded
+    ErrCodeInternal     = 7  // Unexpected server error
+    ErrCodeNotFound     = 8  // Group or gif does not exist
+    ErrCodeInvalidId    = 9  // Malformed id in the route
+    ErrCodeInvalidQuery = 10 // Invalid list query parameters
+    ErrCodeTooLarge     = 11 // Upload is over the size limit
+    ErrCodeNotGif       = 12 // Upload is not a GIF
+    ErrCodeInvalidGif   = 13 // Upload is a corrupt GIF, or over the dimension limit
+    ErrCodeDuplicate    = 14 // Upload looks like a gif already in the group
+    ErrCodeFetch        = 15 // Error fetching a gif from its source_url
+    ErrCodeNotUploaded  = 16 // Direct upload completed before the gif was uploaded
+    ErrCodeUnauthorized = 17 // Missing or invalid credentials
+    ErrCodeForbidden    = 18 // User's role or ownership doesn't allow the request
+)
+
+// AppError is the error returned by route, store and blob storage functions.
+// HTTPErrorHandler renders it into the response envelope.
+type AppError struct {
+    Code    int
+    Status  int
+    Message string
+    Cause   error
+}
+
+func (e *AppError) Error() string {
+    if e.Cause != nil {
+        return e.Message + ": " + e.Cause.Error()
+    }
+    return e.Message
+}
+
+func NewAppError(status, code int, message string, cause error) *AppError {
+    return &AppError{Code: code, Status: status, Message: message, Cause: cause}
+}
+
+func NewInternalError(code int, message string, cause error) *AppError {
+    return NewAppError(http.StatusInternalServerError, code, message, cause)
+}
+
+func NewBadRequestError(code int, message string, cause error) *AppError {
+    return NewAppError(http.StatusBadRequest, code, message, cause)
+}
+
+func NewNotFoundError(message string) *AppError {
+    return NewAppError(http.StatusNotFound, ErrCodeNotFound, message, nil)
 }
 
-func SetBadRequestError(res *ResponseTemplate, errorCode int, errorText string) {
-    /* Error Codes: 
-        4 - Invalid form (missing image or other)
-    */
+func NewUnavailableError(cause error) *AppError {
+    return NewAppError(http.StatusServiceUnavailable, ErrCodeUnavailable, "Store is unavailable", cause)
+}
+
+// StoreError wraps an error from the underlying store with the given code and
+// message. It passes through nil and existing AppErrors, and reports an
+// unreachable store as 503 regardless of code.
+func StoreError(code int, message string, err error) error {
+    switch err.(type) {
+    case nil:
+        return nil
+    case *AppError:
+        return err
+    }
+
+    if err == ErrStoreUnavailable {
+        return NewUnavailableError(err)
+    }
+    return NewInternalError(code, message, err)
+}
+
+// BlobError wraps an error from the blob storage backend. It passes through
+// nil.
+func BlobError(message string, err error) error {
+    if err == nil {
+        return nil
+    }
+    return NewInternalError(ErrCodeBlob, message, err)
+}
+
+// HTTPErrorHandler renders any error returned by a route (or recovered from a
+// panic) into a ResponseTemplate.
+func HTTPErrorHandler(err error, c *echo.Context) {
+    appErr := AsAppError(err)
+    if appErr.Status >= http.StatusInternalServerError {
+        log.Println(err)
+    }
+
+    if c.Response().Committed() {
+        return
+    }
+
+    res := NewResponseTemplate()
+    SetError(res, appErr)
+    c.JSON(res.StatusCode, res)
+}
+
+// AsAppError returns err as it would be rendered: as is if it is an
+// AppError, and otherwise as one standing for an HTTP or server error.
+func AsAppError(err error) *AppError {
+    if appErr, ok := err.(*AppError); ok {
+        return appErr
+    }
+    if he, ok := err.(*echo.HTTPError); ok {
+        return NewAppError(he.Code(), 0, he.Error(), nil)
+    }
+    return NewInternalError(ErrCodeInternal, "Unexpected server error", err)
+}
 
+// SetError fills the error fields of res from err.
+func SetError(res *ResponseTemplate, err *AppError) {
     res.Success = false
-    res.StatusCode = http.StatusBadRequest
-    res.StatusText = http.StatusText(http.StatusBadRequest)
-    res.ErrorCode = errorCode 
-    res.ErrorText = errorText
+    res.StatusCode = err.Status
+    res.StatusText = http.StatusText(err.Status)
+    res.ErrorCode = err.Code
+    res.ErrorText = err.Message
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+    "archive/zip"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "path"
+    "time"
+)
+
+const manifestFile = "manifest.json"
+
+// maxManifestBytes bounds the manifest read on import, well above that of a
+// group with archiveLimits.MaxFiles gifs.
+const maxManifestBytes = 1 << 20
+
+// Manifest describes an exported group: its record, the archive path of its
+// image and the records and archive paths of its gifs.
+type Manifest struct {
+    Group Group         `json:"group"`
+    Cover string        `json:"cover,omitempty"` // empty for the default image
+    Gifs  []ManifestGif `json:"gifs"`
+}
+
+type ManifestGif struct {
+    Gif
+    File string `json:"file"`
+}
+
+// ImportResult reports the group recreated from an archive, and what became
+// of each of its gifs.
+type ImportResult struct {
+    Group *Group       `json:"group"`
+    Gifs  []BulkResult `json:"gifs"`
+}
+
+// NewManifest lays out the archive of group and its gifs. Files are named
+// by id, so that filenames clients uploaded never become archive paths.
+func NewManifest(group *Group, gifs Gifs) *Manifest {
+    manifest := &Manifest{Group: *group, Gifs: make([]ManifestGif, len(gifs))}
+    if len(GroupImagePath(group)) > 0 {
+        manifest.Cover = "cover.gif"
+    }
+    for i, gif := range gifs {
+        manifest.Gifs[i] = ManifestGif{Gif: gif, File: fmt.Sprintf("gifs/%v.gif", gif.Id)}
+    }
+    return manifest
+}
+
+// WriteArchive writes the manifest, followed by every file it names as read
+// from blob storage, to archive.
+func WriteArchive(archive *zip.Writer, manifest *Manifest) error {
+    w, err := archive.Create(manifestFile)
+    if err != nil {
+        return err
+    }
+    err = json.NewEncoder(w).Encode(manifest)
+    if err != nil {
+        return err
+    }
+
+    if len(manifest.Cover) > 0 {
+        err = archiveBlob(archive, manifest.Cover, GroupImagePath(&manifest.Group))
+        if err != nil {
+            return err
+        }
+    }
+    for _, gif := range manifest.Gifs {
+        err = archiveBlob(archive, gif.File, GifFilePath(&gif.Gif))
+        if err != nil {
+            return err
+        }
+    }
+    return archive.Close()
+}
+
+func archiveBlob(archive *zip.Writer, name, blobPath string) error {
+    content, err := blobs.Get(blobPath)
+    if err != nil {
+        return err
+    }
+
+    // GIFs are already compressed, so they are stored as is
+    w, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+    if err != nil {
+        return err
+    }
+    _, err = w.Write(content)
+    return err
+}
+
+// ReadManifest finds and decodes the manifest among the archived files, and
+// indexes the rest by name.
+func ReadManifest(files []*zip.File) (*Manifest, map[string]*zip.File, error) {
+    byName := make(map[string]*zip.File)
+    for _, file := range files {
+        byName[file.Name] = file
+    }
+
+    file, ok := byName[manifestFile]
+    if !ok {
+        return nil, nil, NewBadRequestError(ErrCodeInvalidForm, "Archive has no "+manifestFile, nil)
+    }
+    if file.UncompressedSize64 > maxManifestBytes {
+        return nil, nil, manifestTooLargeError()
+    }
+
+    reader, err := file.Open()
+    if err != nil {
+        return nil, nil, NewBadRequestError(ErrCodeInvalidForm, "Invalid "+manifestFile, err)
+    }
+    defer reader.Close()
+
+    // The size the archive claims may be false, so decoding also stops at
+    // the limit.
+    limited := &io.LimitedReader{R: reader, N: maxManifestBytes + 1}
+    manifest := &Manifest{}
+    err = json.NewDecoder(limited).Decode(manifest)
+    if limited.N == 0 {
+        return nil, nil, manifestTooLargeError()
+    }
+    if err != nil {
+        return nil, nil, NewBadRequestError(ErrCodeInvalidForm, "Invalid "+manifestFile, err)
+    }
+    return manifest, byName, nil
+}
+
+func manifestTooLargeError() error {
+    return NewAppError(http.StatusRequestEntityTooLarge, ErrCodeTooLarge,
+        fmt.Sprintf("%v is larger than %v bytes", manifestFile, maxManifestBytes), nil)
+}
+
+// SaveImportedCover stores the archived cover as the image of group, which
+// keeps the default image if the archive has none.
+func SaveImportedCover(group *Group, cover *zip.File) error {
+    group.ImageUrl = blobs.URL(defaultGroupImage)
+    if cover == nil {
+        return nil
+    }
+
+    content, err := readArchived(cover)
+    if err != nil {
+        return err
+    }
+
+    upload, err := NewUpload(content, cover.Name)
+    if err != nil {
+        return err
+    }
+
+    group.ImageKey, err = SaveObject(upload)
+    if err != nil {
+        return err
+    }
+
+    group.ImageUrl, group.PosterUrl, group.PreviewUrl = ObjectUrls(group.ImageKey)
+    return nil
+}
+
+// ImportGifs adds the gifs listed in manifest to group, reading them from
+// the archived files. The imported gifs belong to whoever owns the group.
+func ImportGifs(group *Group, manifest *Manifest, files map[string]*zip.File) ([]BulkResult, error) {
+    // The group is new, so its only gifs are those imported. Exact copies
+    // are kept, as they were in the exported group.
+    known := &GroupGifs{}
+    results := make([]BulkResult, len(manifest.Gifs))
+    for i, gif := range manifest.Gifs {
+        filename := gif.Filename
+        if len(filename) == 0 {
+            filename = path.Base(gif.File)
+        }
+
+        file, ok := files[gif.File]
+        if !ok {
+            results[i] = BulkResult{Filename: gif.File, Status: BulkRejected, ErrorCode: ErrCodeInvalidForm, ErrorText: "File is missing from the archive"}
+            continue
+        }
+
+        var err error
+        results[i], err = SaveArchivedGif(group, known, group.OwnerId, file, filename, gif.CreatedAt, false)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return results, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "image/color"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+// zipArchive returns a ZIP archive holding contents by name, in the order of
+// names.
+func zipArchive(t *testing.T, names []string, contents map[string]string) []byte {
+    var b bytes.Buffer
+    archive := zip.NewWriter(&b)
+    for _, name := range names {
+        w, err := archive.Create(name)
+        if err == nil {
+            _, err = w.Write([]byte(contents[name]))
+        }
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := archive.Close(); err != nil {
+        t.Fatal(err)
+    }
+    return b.Bytes()
+}
+
+// zipFiles returns the files of a ZIP archive holding contents by name.
+func zipFiles(t *testing.T, contents map[string]string) []*zip.File {
+    var names []string
+    for name := range contents {
+        names = append(names, name)
+    }
+    b := zipArchive(t, names, contents)
+
+    reader, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return reader.File
+}
+
+func TestReadManifestLimit(t *testing.T) {
+    manifest, _, err := ReadManifest(zipFiles(t, map[string]string{manifestFile: `{"group": {"name": "small"}}`}))
+    if err != nil || manifest.Group.Name != "small" {
+        t.Errorf("got manifest %+v, error %v", manifest, err)
+    }
+
+    // A manifest of spaces compresses to next to nothing.
+    padded := `{"group": {"name": "big"}` + strings.Repeat(" ", maxManifestBytes) + `}`
+    _, _, err = ReadManifest(zipFiles(t, map[string]string{manifestFile: padded}))
+    if status, code := fetchErrorCode(t, err); status != http.StatusRequestEntityTooLarge || code != ErrCodeTooLarge {
+        t.Errorf("got %v error %v, want %v error %v", status, code, http.StatusRequestEntityTooLarge, ErrCodeTooLarge)
+    }
+}
+
+// exportImport exports a group with a cover and two gifs, imports the
+// archive, and checks that the copy has new ids but the same content.
+func exportImport(t *testing.T, s GroupStore) {
+    e, apiKey := testServer(t, s)
+    groupId, err := postForm(e, apiKey, "/api/v1/groups", map[string]string{"name": "original"}, testGif(t, color.White))
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := "/api/v1/groups/" + strconv.Itoa(groupId)
+    for _, c := range []color.Color{color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}} {
+        if _, err := postForm(e, apiKey, path+"/gifs", nil, testGif(t, c)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    var original Group
+    var originalGifs Gifs
+    getJSON(t, e, "", path, &original)
+    getJSON(t, e, "", path+"/gifs", &originalGifs)
+
+    req, _ := http.NewRequest("GET", path+"/export", nil)
+    rec := httptest.NewRecorder()
+    e.ServeHTTP(rec, req)
+    if rec.Code != http.StatusOK {
+        t.Fatalf("export got %v", rec.Code)
+    }
+
+    var imported ImportResult
+    if code := postArchive(t, e, apiKey, "/api/v1/groups/import", rec.Body.Bytes(), &imported); code != http.StatusOK {
+        t.Fatalf("import got %v", code)
+    }
+    copied := imported.Group
+    if copied == nil || copied.Id == original.Id || copied.Name != original.Name || copied.ImageKey != original.ImageKey {
+        t.Fatalf("imported group %+v, want a copy of %+v under a new id", copied, original)
+    }
+
+    var gifs Gifs
+    getJSON(t, e, "", "/api/v1/groups/"+strconv.Itoa(copied.Id)+"/gifs", &gifs)
+    if len(imported.Gifs) != len(originalGifs) || len(gifs) != len(originalGifs) {
+        t.Fatalf("imported %v results and %v gifs, want %v", len(imported.Gifs), len(gifs), len(originalGifs))
+    }
+    for i, gif := range gifs {
+        if imported.Gifs[i].Status != BulkCreated || gif.Id == originalGifs[i].Id || gif.Sha256 != originalGifs[i].Sha256 {
+            t.Errorf("imported gif %+v from result %+v, want a copy of %+v under a new id", gif, imported.Gifs[i], originalGifs[i])
+        }
+    }
+}
+
+func TestExportImportMemory(t *testing.T) {
+    exportImport(t, NewMemoryStore())
+}
+
+func TestExportImportRedis(t *testing.T) {
+    exportImport(t, testRedisStore(t))
+}
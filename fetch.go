@@ -0,0 +1,175 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/url"
+    "path"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// errPrivateAddress is returned by the fetch client's dialer for addresses
+// that clients must not be able to reach through the API.
+var errPrivateAddress = errors.New("address is not publicly routable")
+
+// reservedRanges are the special-purpose ranges that net.IP's checks leave
+// out, but which may still lead to internal infrastructure. IPv4-mapped
+// addresses need no range of their own, as those checks see through them.
+var reservedRanges = mustParseCIDRs(
+    "0.0.0.0/8",      // this network
+    "100.64.0.0/10",  // carrier-grade NAT
+    "192.0.0.0/24",   // IETF protocol assignments
+    "198.18.0.0/15",  // benchmarking
+    "240.0.0.0/4",    // reserved, and the broadcast address
+    "::/96",          // IPv4-compatible
+    "64:ff9b::/96",   // NAT64
+    "64:ff9b:1::/48", // local-use NAT64
+    "2001::/32",      // Teredo
+    "2002::/16",      // 6to4
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+    ranges := make([]*net.IPNet, len(cidrs))
+    for i, cidr := range cidrs {
+        _, ipNet, err := net.ParseCIDR(cidr)
+        if err != nil {
+            panic(err)
+        }
+        ranges[i] = ipNet
+    }
+    return ranges
+}
+
+// FetchOptions configures the client used to import gifs by URL.
+type FetchOptions struct {
+    Timeout time.Duration
+    // AllowPrivate lets the client reach loopback and private addresses. It
+    // exists for local testing and must stay off in production.
+    AllowPrivate bool
+}
+
+var fetchOptions = FetchOptions{Timeout: 10 * time.Second}
+
+var fetchClient *http.Client
+
+// NewFetchClient returns an HTTP client that gives up after opts.Timeout and,
+// unless opts.AllowPrivate is set, refuses to connect to anything but public
+// addresses. The check runs on every connection, after DNS resolution and
+// for each redirect, so neither a hostname nor a redirect can sneak past it.
+func NewFetchClient(opts FetchOptions) *http.Client {
+    dialer := &net.Dialer{Timeout: opts.Timeout}
+    if !opts.AllowPrivate {
+        dialer.Control = rejectPrivate
+    }
+
+    return &http.Client{
+        Timeout: opts.Timeout,
+        Transport: &http.Transport{
+            Proxy:       nil, // a proxy would connect on our behalf, unchecked
+            DialContext: dialer.DialContext,
+        },
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            if len(via) >= 5 {
+                return errors.New("too many redirects")
+            }
+            return checkFetchUrl(req.URL)
+        },
+    }
+}
+
+func rejectPrivate(network, address string, c syscall.RawConn) error {
+    host, _, err := net.SplitHostPort(address)
+    if err != nil {
+        return err
+    }
+
+    ip := net.ParseIP(host)
+    if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+        ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+        return errPrivateAddress
+    }
+    for _, reserved := range reservedRanges {
+        if reserved.Contains(ip) {
+            return errPrivateAddress
+        }
+    }
+    return nil
+}
+
+func checkFetchUrl(u *url.URL) error {
+    if u.Scheme != "http" && u.Scheme != "https" {
+        return fmt.Errorf("unsupported scheme %q", u.Scheme)
+    }
+    if len(u.Host) == 0 {
+        return errors.New("missing host")
+    }
+    return nil
+}
+
+// IsJSON reports whether the request body is JSON rather than a form.
+func IsJSON(req *http.Request) bool {
+    return strings.HasPrefix(req.Header.Get("Content-Type"), "application/json")
+}
+
+// ReadSourceUrl fetches the image named by the source_url of a JSON request
+// body.
+func ReadSourceUrl(req *http.Request) ([]byte, string, error) {
+    var body struct {
+        SourceUrl string `json:"source_url"`
+    }
+    err := json.NewDecoder(io.LimitReader(req.Body, 64<<10)).Decode(&body)
+    if err != nil || len(body.SourceUrl) == 0 {
+        return nil, "", NewBadRequestError(ErrCodeInvalidForm, "Invalid or missing source_url", err)
+    }
+    return FetchUpload(body.SourceUrl)
+}
+
+// FetchUpload downloads the image at sourceUrl, holding it to the same size
+// limit as uploads.
+func FetchUpload(sourceUrl string) ([]byte, string, error) {
+    u, err := url.Parse(sourceUrl)
+    if err == nil {
+        err = checkFetchUrl(u)
+    }
+    if err != nil {
+        return nil, "", NewBadRequestError(ErrCodeInvalidForm, "Invalid or missing source_url", err)
+    }
+
+    res, err := fetchClient.Get(u.String())
+    if errors.Is(err, errPrivateAddress) {
+        return nil, "", NewBadRequestError(ErrCodeInvalidForm, "source_url is not a public address", err)
+    }
+    if err != nil {
+        return nil, "", NewAppError(http.StatusBadGateway, ErrCodeFetch, "Error fetching source_url", err)
+    }
+    defer res.Body.Close()
+
+    if res.StatusCode != http.StatusOK {
+        return nil, "", NewAppError(http.StatusBadGateway, ErrCodeFetch,
+            fmt.Sprintf("Error fetching source_url: %v", res.Status), nil)
+    }
+    if res.ContentLength > int64(uploadLimits.MaxBytes) {
+        return nil, "", tooLargeError()
+    }
+
+    content, err := ioutil.ReadAll(io.LimitReader(res.Body, int64(uploadLimits.MaxBytes)+1))
+    if err != nil {
+        return nil, "", NewAppError(http.StatusBadGateway, ErrCodeFetch, "Error fetching source_url", err)
+    }
+    if len(content) > uploadLimits.MaxBytes {
+        return nil, "", tooLargeError()
+    }
+
+    filename := path.Base(res.Request.URL.Path)
+    if filename == "/" || filename == "." {
+        filename = "remote.gif"
+    }
+    return content, filename, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "image/color"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+// useFetchClient makes FetchUpload use client until the test ends.
+func useFetchClient(t *testing.T, client *http.Client) {
+    previous := fetchClient
+    t.Cleanup(func() { fetchClient = previous })
+    fetchClient = client
+}
+
+// fetchErrorCode returns the status and code of err, an AppError.
+func fetchErrorCode(t *testing.T, err error) (int, int) {
+    appErr, ok := err.(*AppError)
+    if !ok {
+        t.Fatalf("got error %v, want an AppError", err)
+    }
+    return appErr.Status, appErr.Code
+}
+
+func TestFetchUpload(t *testing.T) {
+    previous := uploadLimits
+    defer func() { uploadLimits = previous }()
+    uploadLimits.MaxBytes = 1000
+
+    image := testGif(t, color.White)
+    mux := http.NewServeMux()
+    mux.HandleFunc("/good.gif", func(w http.ResponseWriter, req *http.Request) {
+        w.Write(image)
+    })
+    mux.HandleFunc("/page.html", func(w http.ResponseWriter, req *http.Request) {
+        w.Write([]byte("<html></html>"))
+    })
+    mux.HandleFunc("/big.gif", func(w http.ResponseWriter, req *http.Request) {
+        // Flushing leaves out the Content-Length, so the limit is met while
+        // reading the body.
+        w.(http.Flusher).Flush()
+        w.Write(bytes.Repeat([]byte{0}, uploadLimits.MaxBytes+1))
+    })
+    server := httptest.NewServer(mux)
+    defer server.Close()
+
+    useFetchClient(t, NewFetchClient(FetchOptions{Timeout: 5 * time.Second, AllowPrivate: true}))
+
+    content, filename, err := FetchUpload(server.URL + "/good.gif")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(content, image) || filename != "good.gif" {
+        t.Errorf("got %v bytes named %v, want the gif as good.gif", len(content), filename)
+    }
+
+    content, filename, err = FetchUpload(server.URL + "/page.html")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = NewUpload(content, filename)
+    if status, code := fetchErrorCode(t, err); status != http.StatusUnsupportedMediaType || code != ErrCodeNotGif {
+        t.Errorf("non-GIF: got %v error %v, want %v error %v", status, code, http.StatusUnsupportedMediaType, ErrCodeNotGif)
+    }
+
+    _, _, err = FetchUpload(server.URL + "/big.gif")
+    if status, code := fetchErrorCode(t, err); status != http.StatusRequestEntityTooLarge || code != ErrCodeTooLarge {
+        t.Errorf("oversized: got %v error %v, want %v error %v", status, code, http.StatusRequestEntityTooLarge, ErrCodeTooLarge)
+    }
+
+    _, _, err = FetchUpload(server.URL + "/missing.gif")
+    if status, code := fetchErrorCode(t, err); status != http.StatusBadGateway || code != ErrCodeFetch {
+        t.Errorf("not found: got %v error %v, want %v error %v", status, code, http.StatusBadGateway, ErrCodeFetch)
+    }
+}
+
+func TestFetchRefusesPrivate(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        t.Error("the fetch client reached a loopback address")
+    }))
+    defer server.Close()
+
+    useFetchClient(t, NewFetchClient(FetchOptions{Timeout: 5 * time.Second}))
+
+    _, _, err := FetchUpload(server.URL + "/good.gif")
+    if status, code := fetchErrorCode(t, err); status != http.StatusBadRequest || code != ErrCodeInvalidForm {
+        t.Errorf("got %v error %v, want %v error %v", status, code, http.StatusBadRequest, ErrCodeInvalidForm)
+    }
+}
+
+func TestFetchRefusesPrivateRedirect(t *testing.T) {
+    private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        t.Error("the fetch client followed a redirect to a loopback address")
+    }))
+    defer private.Close()
+
+    redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        http.Redirect(w, req, private.URL+"/good.gif", http.StatusFound)
+    }))
+    defer redirecting.Close()
+
+    // Stand the redirecting server in for a public host, leaving every other
+    // connection to the client's own checks.
+    client := NewFetchClient(FetchOptions{Timeout: 5 * time.Second})
+    transport := client.Transport.(*http.Transport)
+    dial := transport.DialContext
+    transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+        if address == "public.example:80" {
+            return (&net.Dialer{}).DialContext(ctx, network, redirecting.Listener.Addr().String())
+        }
+        return dial(ctx, network, address)
+    }
+    useFetchClient(t, client)
+
+    _, _, err := FetchUpload("http://public.example/good.gif")
+    if status, code := fetchErrorCode(t, err); status != http.StatusBadRequest || code != ErrCodeInvalidForm {
+        t.Errorf("got %v error %v, want %v error %v", status, code, http.StatusBadRequest, ErrCodeInvalidForm)
+    }
+}
+
+func TestRejectPrivate(t *testing.T) {
+    tests := []struct {
+        ip      string
+        private bool
+    }{
+        {"93.184.216.34", false},
+        {"2606:2800:220:1:248:1893:25c8:1946", false},
+        {"127.0.0.1", true},
+        {"10.1.2.3", true},
+        {"169.254.169.254", true},
+        {"100.64.0.1", true},
+        {"0.0.0.0", true},
+        {"0.1.2.3", true},
+        {"192.0.0.170", true},
+        {"198.18.0.1", true},
+        {"198.19.255.255", true},
+        {"255.255.255.255", true},
+        {"::1", true},
+        {"fd00::1", true},
+        {"fe80::1", true},
+        {"::ffff:127.0.0.1", true},
+        {"::ffff:10.0.0.1", true},
+        {"::ffff:93.184.216.34", false},
+        {"::127.0.0.1", true},
+        {"64:ff9b::a00:1", true},
+        {"64:ff9b:1::a00:1", true},
+        {"2001:0:4136:e378:8000:63bf:3fff:fdd2", true},
+        {"2002:a00:1::1", true},
+    }
+    for _, test := range tests {
+        err := rejectPrivate("tcp", net.JoinHostPort(test.ip, "80"), nil)
+        if private := err == errPrivateAddress; private != test.private {
+            t.Errorf("%v: got private %v, want %v", test.ip, private, test.private)
+        }
+    }
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    SortById      = "id"
+    SortByCreated = "created"
+
+    DefaultListLimit = 50
+    MaxListLimit     = 200
+)
+
+// ListQuery selects one page of a list endpoint.
+type ListQuery struct {
+    Limit int
+    Sort  string // SortById or SortByCreated
+    Desc  bool
+    // After is the last item of the previous page, decoded from the cursor.
+    // It is nil for the first page.
+    After *ListItem
+}
+
+// Page describes where a page sits in the full list. NextCursor is empty on
+// the last page. Total is nil for lists filtered for the user, whose total
+// would count items they can't see.
+type Page struct {
+    NextCursor string `json:"next_cursor"`
+    Total      *int   `json:"total,omitempty"`
+}
+
+// ListItem is the part of a record needed to order and page it.
+type ListItem struct {
+    Id    int
+    Score int64 // see createdScore
+}
+
+// createdScore orders records by creation time, in milliseconds. Records
+// saved before creation times were recorded fall back to their id, which
+// sorts them first and in id order.
+func createdScore(id int, createdAt time.Time) int64 {
+    if createdAt.IsZero() {
+        return int64(id)
+    }
+    return createdAt.UnixNano() / int64(time.Millisecond)
+}
+
+func groupScore(g *Group) int64 {
+    return createdScore(g.Id, g.CreatedAt)
+}
+
+func gifScore(gif *Gif) int64 {
+    return createdScore(gif.Id, gif.CreatedAt)
+}
+
+// Cursor encodes item as the cursor of a page ending with it.
+func (q ListQuery) Cursor(item ListItem) string {
+    if q.Sort == SortByCreated {
+        return fmt.Sprintf("%d_%d", item.Score, item.Id)
+    }
+    return strconv.Itoa(item.Id)
+}
+
+// ParseCursor decodes a cursor made by Cursor for the same sort into q.After.
+func (q *ListQuery) ParseCursor(cursor string) error {
+    if len(cursor) == 0 {
+        q.After = nil
+        return nil
+    }
+
+    item := &ListItem{}
+    var err error
+    if q.Sort == SortByCreated {
+        parts := strings.SplitN(cursor, "_", 2)
+        if len(parts) != 2 {
+            return fmt.Errorf("malformed cursor %q", cursor)
+        }
+        if item.Score, err = strconv.ParseInt(parts[0], 10, 64); err == nil {
+            item.Id, err = strconv.Atoi(parts[1])
+        }
+    } else {
+        item.Id, err = strconv.Atoi(cursor)
+    }
+    if err != nil {
+        return err
+    }
+
+    q.After = item
+    return nil
+}
+
+// before reports whether a comes before b in the order q asks for.
+func (q ListQuery) before(a, b ListItem) bool {
+    if q.Desc {
+        a, b = b, a
+    }
+    if q.Sort == SortByCreated && a.Score != b.Score {
+        return a.Score < b.Score
+    }
+    return a.Id < b.Id
+}
+
+type listItems struct {
+    items []ListItem
+    q     ListQuery
+}
+
+func (l listItems) Len() int           { return len(l.items) }
+func (l listItems) Swap(i, j int)      { l.items[i], l.items[j] = l.items[j], l.items[i] }
+func (l listItems) Less(i, j int) bool { return l.q.before(l.items[i], l.items[j]) }
+
+// Paginate orders items as q asks and returns the page following q.After,
+// along with the cursor for the page after that.
+func Paginate(items []ListItem, q ListQuery) ([]ListItem, string) {
+    sort.Sort(listItems{items, q})
+
+    start := 0
+    if q.After != nil {
+        start = sort.Search(len(items), func(i int) bool { return q.before(*q.After, items[i]) })
+    }
+
+    end := start + q.Limit
+    if end >= len(items) {
+        return items[start:], ""
+    }
+    return items[start:end], q.Cursor(items[end-1])
+}
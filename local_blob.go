@@ -0,0 +1,245 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "path"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/labstack/echo"
+)
+
+// localBlobRoute is where the API serves files kept by a LocalBlobStore.
+const localBlobRoute = "/files/"
+
+// LocalBlobStore keeps files on the local disk under Dir. It is meant for
+// development and CI, where AWS credentials are not available; the API serves
+// the files itself from localBlobRoute with ServeFile, and accepts signed
+// uploads there with PutSigned.
+type LocalBlobStore struct {
+    Dir     string
+    BaseUrl string
+    // signingKey signs upload URLs. It is made afresh on every start, which
+    // invalidates any URLs issued before.
+    signingKey []byte
+}
+
+func NewLocalBlobStore(dir, baseUrl string) (*LocalBlobStore, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, err
+    }
+
+    key := make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+        return nil, err
+    }
+    return &LocalBlobStore{Dir: dir, BaseUrl: strings.TrimSuffix(baseUrl, "/"), signingKey: key}, nil
+}
+
+func (s *LocalBlobStore) Put(p string, data []byte, contentType string) error {
+    file := s.file(p)
+    err := os.MkdirAll(filepath.Dir(file), 0755)
+    if err == nil {
+        err = ioutil.WriteFile(file, data, 0644)
+    }
+    return BlobError("Error uploading image to storage", err)
+}
+
+func (s *LocalBlobStore) Writer(p string, contentType string) (BlobWriter, error) {
+    file := s.file(p)
+    err := os.MkdirAll(filepath.Dir(file), 0755)
+    if err != nil {
+        return nil, BlobError("Error uploading image to storage", err)
+    }
+
+    // write beside the destination, so Close can move the file into place
+    // in one step
+    temp, err := ioutil.TempFile(filepath.Dir(file), ".upload-")
+    if err != nil {
+        return nil, BlobError("Error uploading image to storage", err)
+    }
+    return &localWriter{File: temp, path: file}, nil
+}
+
+func (s *LocalBlobStore) Copy(from, to string) error {
+    src, err := os.Open(s.file(from))
+    if err != nil {
+        return BlobError("Error copying image in storage", err)
+    }
+    defer src.Close()
+
+    w, err := s.Writer(to, "")
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(w, src)
+    if err != nil {
+        w.Abort()
+        return BlobError("Error copying image in storage", err)
+    }
+    return w.Close()
+}
+
+func (s *LocalBlobStore) Get(p string) ([]byte, error) {
+    data, err := ioutil.ReadFile(s.file(p))
+    return data, BlobError("Error reading image from storage", err)
+}
+
+func (s *LocalBlobStore) Reader(p string) (io.ReadCloser, error) {
+    f, err := os.Open(s.file(p))
+    if err != nil {
+        return nil, BlobError("Error reading image from storage", err)
+    }
+    return f, nil
+}
+
+func (s *LocalBlobStore) Exists(p string) (bool, error) {
+    _, err := os.Stat(s.file(p))
+    if os.IsNotExist(err) {
+        return false, nil
+    }
+    return err == nil, BlobError("Error reading image from storage", err)
+}
+
+func (s *LocalBlobStore) Delete(p string) error {
+    err := os.Remove(s.file(p))
+    if os.IsNotExist(err) {
+        return nil
+    }
+    return BlobError("Error deleting image from storage", err)
+}
+
+func (s *LocalBlobStore) DeletePrefix(prefix string) error {
+    if s.clean(prefix) == "/" {
+        return BlobError("Error deleting images from storage", errors.New("refusing to delete the whole store"))
+    }
+
+    cleaned := s.clean(prefix)
+    if strings.HasSuffix(prefix, "/") {
+        cleaned += "/"
+    }
+
+    dir, name := path.Split(cleaned)
+    matches, err := filepath.Glob(filepath.Join(s.file(dir), name+"*"))
+    if err != nil {
+        return BlobError("Error deleting images from storage", err)
+    }
+    for _, match := range matches {
+        if err := os.RemoveAll(match); err != nil {
+            return BlobError("Error deleting images from storage", err)
+        }
+    }
+    return nil
+}
+
+func (s *LocalBlobStore) URL(p string) string {
+    return s.BaseUrl + s.clean(p)
+}
+
+type localWriter struct {
+    *os.File
+    path string
+}
+
+func (w *localWriter) Close() error {
+    err := w.File.Close()
+    if err == nil {
+        err = os.Rename(w.Name(), w.path)
+    }
+    if err != nil {
+        os.Remove(w.Name())
+    }
+    return BlobError("Error uploading image to storage", err)
+}
+
+func (w *localWriter) Abort() error {
+    w.File.Close()
+    err := os.Remove(w.Name())
+    if os.IsNotExist(err) {
+        return nil
+    }
+    return BlobError("Error discarding upload", err)
+}
+
+func (s *LocalBlobStore) SignedPutURL(p, contentType string, expires time.Time) (string, map[string]string, error) {
+    expiresAt := strconv.FormatInt(expires.Unix(), 10)
+    query := url.Values{"expires": {expiresAt}, "signature": {s.sign(s.clean(p), expiresAt)}}
+    return s.URL(p) + "?" + query.Encode(), map[string]string{"Content-Type": contentType}, nil
+}
+
+func (s *LocalBlobStore) sign(p, expiresAt string) string {
+    mac := hmac.New(sha256.New, s.signingKey)
+    mac.Write([]byte("PUT\n" + p + "\n" + expiresAt))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ServeFile serves the file named by the rest of the route, unless it is
+// private.
+func (s *LocalBlobStore) ServeFile(c *echo.Context) error {
+    p := s.clean(c.P(0))
+    if isPrivatePath(p) {
+        return NewNotFoundError("File not found")
+    }
+
+    f, err := os.Open(s.file(p))
+    if err != nil {
+        return NewNotFoundError("File not found")
+    }
+    defer f.Close()
+
+    info, err := f.Stat()
+    if err != nil || info.IsDir() {
+        return NewNotFoundError("File not found")
+    }
+    http.ServeContent(c.Response(), c.Request(), info.Name(), info.ModTime(), f)
+    return nil
+}
+
+// PutSigned stores the body of a PUT to a URL made by SignedPutURL, within
+// uploadLimits.MaxBytes.
+func (s *LocalBlobStore) PutSigned(c *echo.Context) error {
+    p := s.clean(c.P(0))
+    expiresAt := c.Query("expires")
+    expires, err := strconv.ParseInt(expiresAt, 10, 64)
+    if err != nil || time.Now().Unix() > expires || !hmac.Equal([]byte(c.Query("signature")), []byte(s.sign(p, expiresAt))) {
+        return NewAppError(http.StatusForbidden, ErrCodeInvalidForm, "Invalid or expired upload URL", err)
+    }
+
+    w, err := s.Writer(p, c.Request().Header.Get("Content-Type"))
+    if err != nil {
+        return err
+    }
+
+    n, err := io.Copy(w, io.LimitReader(c.Request().Body, int64(uploadLimits.MaxBytes)+1))
+    if err == nil && n > int64(uploadLimits.MaxBytes) {
+        err = tooLargeError()
+    }
+    if err == nil {
+        err = w.Close()
+    }
+    if err != nil {
+        w.Abort()
+        return err
+    }
+    return c.NoContent(http.StatusOK)
+}
+
+// clean roots p so that it can never point outside of Dir.
+func (s *LocalBlobStore) clean(p string) string {
+    return path.Clean("/" + p)
+}
+
+func (s *LocalBlobStore) file(p string) string {
+    return filepath.Join(s.Dir, filepath.FromSlash(s.clean(p)))
+}
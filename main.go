@@ -1,32 +1,57 @@
 package main
 
 import (
-    "encoding/json"
+    "archive/zip"
     "fmt"
-    "io/ioutil"
+    "log"
+    "mime"
     "net/http"
     "os"
+    "path"
     "strconv"
+    "strings"
+    "time"
 
     "github.com/labstack/echo"
     mw "github.com/labstack/echo/middleware"
 
-    "github.com/garyburd/redigo/redis"
-    "github.com/mitchellh/goamz/aws"
-    "github.com/mitchellh/goamz/s3"
     "github.com/tmilewski/goenv"
 )
 
 type Group struct {
-    Id       int    `json:"id"`
-    Name     string `json:"name"`
-    ImageUrl string `json:"image_url"`
+    Id         int       `json:"id"`
+    Name       string    `json:"name"`
+    OwnerId    int       `json:"owner_id"`
+    Visibility string    `json:"visibility"` // VisibilityPublic, VisibilityUnlisted or VisibilityPrivate
+    Hidden     bool      `json:"hidden"`     // by a moderator
+    ImageKey   string    `json:"image_key"`
+    ImageUrl   string    `json:"image_url"`
+    PosterUrl  string    `json:"poster_url"`
+    PreviewUrl string    `json:"preview_url"`
+    CreatedAt  time.Time `json:"created_at"`
 }
 
 type Gif struct {
-    Id       int    `json:"id"`
-    GroupId  int    `json:"group_id"`
-    ImageUrl string `json:"image_url"`
+    Id         int       `json:"id"`
+    GroupId    int       `json:"group_id"`
+    OwnerId    int       `json:"owner_id"` // the uploader
+    Hidden     bool      `json:"hidden"`   // by a moderator
+    Filename   string    `json:"filename"` // as uploaded
+    ImageKey   string    `json:"image_key"`
+    ImageUrl   string    `json:"image_url"`
+    PosterUrl  string    `json:"poster_url"`
+    PreviewUrl string    `json:"preview_url"`
+    Width      int       `json:"width"`
+    Height     int       `json:"height"`
+    Frames     int       `json:"frames"`
+    DurationMs int       `json:"duration_ms"`
+    LoopCount  int       `json:"loop_count"` // 0 loops forever, -1 plays once
+    Size       int       `json:"size"`
+    Sha256     string    `json:"sha256"`
+    PHash      []string  `json:"phash"`
+    Upvotes    int       `json:"upvotes"`
+    Downvotes  int       `json:"downvotes"`
+    CreatedAt  time.Time `json:"created_at"`
 }
 
 type Groups []Group
@@ -34,6 +59,8 @@ type Gifs []Gif
 
 type ResponseTemplate struct {
     Content    interface{} `json:"content"`
+    Page       *Page       `json:"page,omitempty"`
+    Warnings   []string    `json:"warnings,omitempty"`
     ErrorCode  int         `json:"error_code"`
     ErrorText  string      `json:"error_text"`
     StatusCode int         `json:"status_code"`
@@ -41,313 +68,1568 @@ type ResponseTemplate struct {
     Success    bool        `json:"success"`
 }
 
-var groupSeq = 1 // default
-var gifSeq = 1   // default
+// defaultGroupImage is the image of groups created without one.
+const defaultGroupImage = "default/group-default.gif"
 
-func init() { // connect to Redis on init, and get highest group ID
+var store GroupStore
+var blobs BlobStore
+
+func init() { // load the environment and set up the configured stores on init
     err := goenv.Load()
     if err != nil {
         fmt.Println("Missing environment variables file")
         panic(err)
     }
 
-    rC := RedisConnection()
-    defer rC.Close()
+    store, err = NewGroupStore(os.Getenv("STORE"))
+    ErrorHandler(err)
 
-    groupSeqValue, err := redis.Int(rC.Do("GET", "id:groups"))
-    if err != nil {
-        _, err := rC.Do("SET", "id:groups", 1) // initialize if doesn't exist
-        ErrorHandler(err)
+    blobs, err = NewBlobStore(os.Getenv("BLOB_STORE"))
+    ErrorHandler(err)
 
-        groupSeqValue = 1
+    uploadLimits.MaxBytes = envInt("MAX_UPLOAD_BYTES", uploadLimits.MaxBytes)
+    uploadLimits.MaxDimension = envInt("MAX_GIF_DIMENSION", uploadLimits.MaxDimension)
+    uploadLimits.MaxFrames = envInt("MAX_GIF_FRAMES", uploadLimits.MaxFrames)
+    uploadLimits.MaxPixels = envInt("MAX_GIF_PIXELS", uploadLimits.MaxPixels)
+    archiveLimits.MaxBytes = envInt("MAX_ARCHIVE_BYTES", archiveLimits.MaxBytes)
+    archiveLimits.MaxFiles = envInt("MAX_ARCHIVE_FILES", archiveLimits.MaxFiles)
+    previewMaxDimension = envInt("PREVIEW_MAX_DIMENSION", previewMaxDimension)
+
+    uploadUrlTTL = envDuration("UPLOAD_URL_TTL", uploadUrlTTL)
+    inviteTTL = envDuration("INVITE_TTL", inviteTTL)
+
+    tokenOptions.AccessTTL = envDuration("JWT_ACCESS_TTL", tokenOptions.AccessTTL)
+    tokenOptions.RefreshTTL = envDuration("JWT_REFRESH_TTL", tokenOptions.RefreshTTL)
+    if keys := os.Getenv("JWT_KEYS"); len(keys) > 0 {
+        tokenOptions.Keys, err = ParseSigningKeys(keys)
+        ErrorHandler(err)
+    } else {
+        key, err := EphemeralSigningKey()
+        ErrorHandler(err)
+        tokenOptions.Keys = []SigningKey{key}
     }
 
-    gifSeqValue, err := redis.Int(rC.Do("GET", "id:gifs"))
-    if err != nil {
-        _, err := rC.Do("SET", "id:gifs", 1) // initialize if doesn't exist
-        ErrorHandler(err)
+    fetchOptions.Timeout = envDuration("FETCH_TIMEOUT", fetchOptions.Timeout)
+    fetchOptions.AllowPrivate = envOr("FETCH_ALLOW_PRIVATE", "false") == "true"
+    fetchClient = NewFetchClient(fetchOptions)
 
-        gifSeqValue = 1
+    duplicatePolicy.Action = envOr("DUPLICATE_POLICY", duplicatePolicy.Action)
+    duplicatePolicy.Threshold = envInt("DUPLICATE_THRESHOLD", duplicatePolicy.Threshold)
+    switch duplicatePolicy.Action {
+    case DuplicateReject, DuplicateWarn, DuplicateAllow:
+    default:
+        ErrorHandler(fmt.Errorf("unknown duplicate policy %q", duplicatePolicy.Action))
     }
-
-    groupSeq = groupSeqValue
-    gifSeq = gifSeqValue
 }
 
 func main() {
+    if len(os.Args) > 1 {
+        RunCommand(os.Args[1:])
+        return
+    }
+
     e := echo.New()
+    e.SetHTTPErrorHandler(HTTPErrorHandler)
 
     e.Use(mw.Logger())
     e.Use(mw.Recover())
+    AddRoutes(e)
+
+    e.Run(os.Getenv("API_PORT"))
+}
+
+// AddRoutes registers the API's routes, and those serving the local blob
+// store if it is in use, on e.
+func AddRoutes(e *echo.Echo) {
+    if local, ok := blobs.(*LocalBlobStore); ok {
+        e.Get(localBlobRoute+"*", local.ServeFile)
+        e.Put(localBlobRoute+"*", local.PutSigned)
+    }
 
     v1 := e.Group("/api/v1")
+    v1.Use(Authenticate)
 
     // Routes
+    v1.Get("/status", GetStatus)
+    v1.Post("/users", PostUsers)
+    v1.Get("/users/me", GetUserMe)
+    v1.Put("/users/:id/role", PutUserRole)
+    v1.Post("/users/me/keys", PostUserKeys)
+    v1.Delete("/users/me/keys/:key_id", DeleteUserKey)
+    v1.Post("/auth/login", PostAuthLogin)
+    v1.Post("/auth/refresh", PostAuthRefresh)
+    v1.Post("/auth/logout", PostAuthLogout)
     v1.Get("/groups", GetGroups)
+    v1.Get("/groups/:id", GetGroup)
     v1.Get("/groups/:id/gifs", GetGroupGifs)
+    v1.Get("/groups/:id/export", GetGroupExport)
+    v1.Get("/groups/:id/leaderboard", GetGroupLeaderboard)
     v1.Post("/groups", PostGroups)
+    v1.Post("/groups/import", PostGroupImport)
+    v1.Patch("/groups/:id", PatchGroup)
+    v1.Delete("/groups/:id", DeleteGroup)
+    v1.Get("/groups/:id/members", GetGroupMembers)
+    v1.Delete("/groups/:id/members/:user_id", DeleteGroupMember)
+    v1.Post("/groups/:id/invites", PostGroupInvite)
+    v1.Delete("/groups/:id/invites/:code", DeleteGroupInvite)
+    v1.Post("/invites/:code/accept", PostInviteAccept)
+    v1.Post("/groups/:id/hide", PostGroupHide)
+    v1.Post("/groups/:id/unhide", PostGroupUnhide)
     v1.Post("/groups/:id/gifs", PostGroupGif)
-
-    e.Run(os.Getenv("API_PORT"))
+    v1.Post("/groups/:id/gifs/bulk", PostGroupGifsBulk)
+    v1.Post("/groups/:id/gifs/uploads", PostGroupGifUpload)
+    v1.Post("/groups/:id/gifs/uploads/:upload_id/complete", PostGroupGifUploadComplete)
+    v1.Get("/gifs/duplicates", GetGifDuplicates)
+    v1.Get("/gifs/:id", GetGif)
+    v1.Delete("/gifs/:id", DeleteGif)
+    v1.Post("/gifs/:id/move", PostGifMove)
+    v1.Post("/gifs/:id/hide", PostGifHide)
+    v1.Post("/gifs/:id/unhide", PostGifUnhide)
+    v1.Post("/gifs/:id/vote", PostGifVote)
+    v1.Delete("/gifs/:id/vote", DeleteGifVote)
 }
 
 // Route Functions
-func GetGroups(c *echo.Context) error {
+func PostUsers(c *echo.Context) error {
     res := NewResponseTemplate()
+    name := strings.TrimSpace(c.Form("name"))
+    if len(name) == 0 {
+        return NewBadRequestError(ErrCodeInvalidForm, "Missing name", nil)
+    }
 
-    groups, err := FindAllGroups(res)
+    userId, err := store.NextUserId()
     if err != nil {
-        SetInternalServerError(res, 3, "Server error finding groups")
-        return c.JSON(res.StatusCode, res)
+        return err
     }
 
-    res.Content = groups
+    user := &User{}
+    user.Id = userId
+    user.Name = name
+    user.Role = RolePlayer
+    user.CreatedAt = time.Now().UTC()
+
+    err = store.SaveUser(user)
+    if err != nil {
+        return err
+    }
+
+    key, err := NewApiKey(user)
+    if err != nil {
+        return err
+    }
+
+    res.Content = key
     return c.JSON(res.StatusCode, res)
 }
 
-func GetGroupGifs(c *echo.Context) error {
+func GetUserMe(c *echo.Context) error {
     res := NewResponseTemplate()
-    groupId, err := strconv.Atoi(c.Param("id"))
-    ErrorHandler(err)
+    user, err := CurrentUser(c)
+    if err != nil {
+        return err
+    }
+
+    res.Content = user
+    return c.JSON(res.StatusCode, res)
+}
 
-    gifs, err := FindGroupGifs(c.Request(), groupId)
+func PostUserKeys(c *echo.Context) error {
+    res := NewResponseTemplate()
+    user, err := CurrentUser(c)
     if err != nil {
-        SetInternalServerError(res, 3, "Server error finding group gifs")
+        return err
     }
 
-    res.Content = gifs
+    key, err := NewApiKey(user)
+    if err != nil {
+        return err
+    }
 
-    return c.JSON(http.StatusOK, res)
+    res.Content = key
+    return c.JSON(res.StatusCode, res)
 }
 
-func PostGroups(c *echo.Context) error {
+func DeleteUserKey(c *echo.Context) error {
     res := NewResponseTemplate()
+    user, err := CurrentUser(c)
+    if err != nil {
+        return err
+    }
 
-    group := &Group{}
-    group.Id = groupSeq
-    if group.Name = "Unnamed Group"; len(c.Form("name")) > 0 {
-        group.Name = c.Form("name")
+    key, err := store.FindApiKey(c.Param("key_id"))
+    if err != nil {
+        return err
     }
+    if key.UserId != user.Id {
+        return NewNotFoundError("API key not found")
+    }
+
+    err = store.DeleteApiKey(key.Id)
+    if err != nil {
+        return err
+    }
+
+    return c.JSON(res.StatusCode, res)
+}
 
-    err := SaveGroupImage(c.Request(), group, res)
+func PostAuthLogin(c *echo.Context) error {
+    res := NewResponseTemplate()
+    user, err := CurrentUser(c)
     if err != nil {
-        return c.JSON(res.StatusCode, res)
+        return err
+    }
+    if c.Get(claimsContextKey) != nil {
+        return NewAppError(http.StatusUnauthorized, ErrCodeUnauthorized, "Log in with an API key", nil)
     }
 
-    err = SaveGroup(group, res)
+    tokens, err := NewTokenPair(user)
     if err != nil {
-        return c.JSON(res.StatusCode, res)
+        return err
     }
 
-    res.Content = group
-    return c.JSON(http.StatusOK, res)
+    res.Content = tokens
+    return c.JSON(res.StatusCode, res)
 }
 
-func PostGroupGif(c *echo.Context) error {
+func PostAuthRefresh(c *echo.Context) error {
     res := NewResponseTemplate()
-    groupId, err := strconv.Atoi(c.Param("id"))
+    claims, err := VerifyToken(c.Form("refresh_token"), TokenRefresh)
     if err != nil {
-        SetBadRequestError(res, 4, "Invalid group id for gif")
+        return err
     }
 
-    gif := &Gif{}
-    gif.Id = gifSeq
-    gif.GroupId = groupId
+    user, err := FindTokenUser(claims)
+    if err != nil {
+        return err
+    }
 
-    err = SaveGifToGroup(c.Request(), gif, res)
+    // Refresh tokens are used once, so a stolen one stops working as soon as
+    // either party refreshes with it. Only the refresh that revokes it gets
+    // new tokens, however many race to use it.
+    revoked, err := RevokeToken(claims)
     if err != nil {
-        return c.JSON(res.StatusCode, res)
+        return err
+    }
+    if !revoked {
+        return NewAppError(http.StatusUnauthorized, ErrCodeUnauthorized, "Token has been revoked", nil)
     }
 
-    err = SaveGif(gif, res)
+    tokens, err := NewTokenPair(user)
     if err != nil {
-        return c.JSON(res.StatusCode, res)
+        return err
     }
 
-    res.Content = gif
-    return c.JSON(http.StatusOK, res)
+    res.Content = tokens
+    return c.JSON(res.StatusCode, res)
 }
 
-// Util Functions
-func RedisConnection() redis.Conn {
-    c, err := redis.Dial("tcp", os.Getenv("REDIS_PORT"))
-    ErrorHandler(err)
-    return c
-}
+func PostAuthLogout(c *echo.Context) error {
+    res := NewResponseTemplate()
+    claims, ok := c.Get(claimsContextKey).(*TokenClaims)
+    if !ok {
+        return NewAppError(http.StatusUnauthorized, ErrCodeUnauthorized, "Log out with an access token", nil)
+    }
 
-func ErrorHandler(err error) {
+    if refreshToken := c.Form("refresh_token"); len(refreshToken) > 0 {
+        refresh, err := VerifyToken(refreshToken, TokenRefresh)
+        if err != nil {
+            return err
+        }
+        _, err = RevokeToken(refresh)
+        if err != nil {
+            return err
+        }
+    }
+
+    _, err := RevokeToken(claims)
     if err != nil {
-        panic(err)
+        return err
     }
+
+    return c.JSON(res.StatusCode, res)
 }
 
-func S3Bucket() *s3.Bucket {
-    auth, err := aws.EnvAuth()
-    ErrorHandler(err)
+func PutUserRole(c *echo.Context) error {
+    res := NewResponseTemplate()
+    err := CheckAdmin(RequestUser(c))
+    if err != nil {
+        return err
+    }
+
+    id, err := IdParam(c)
+    if err != nil {
+        return err
+    }
+
+    user, err := store.FindUser(id)
+    if err != nil {
+        return err
+    }
+
+    user.Role = c.Form("role")
+    if !ValidRole(user.Role) {
+        return NewBadRequestError(ErrCodeInvalidForm, "role must be player, moderator or admin", nil)
+    }
+
+    err = store.SaveUser(user)
+    if err != nil {
+        return err
+    }
 
-    client := s3.New(auth, aws.USEast)
-    b := client.Bucket("cc-gifgroup-api")
-    return b
+    res.Content = user
+    return c.JSON(res.StatusCode, res)
 }
 
-func NewResponseTemplate() *ResponseTemplate {
-    template := &ResponseTemplate{}
-    template.Success = true
-    template.StatusCode = http.StatusOK
-    template.StatusText = http.StatusText(http.StatusOK)
-    template.ErrorCode = 0
-    template.ErrorText = "No Error"
-    return template
+func GetStatus(c *echo.Context) error {
+    res := NewResponseTemplate()
+
+    status := store.Status()
+    if !status.Healthy {
+        SetError(res, NewUnavailableError(nil))
+    }
+
+    // The backend, pool and error would tell anyone where the store runs,
+    // so only operators see them.
+    if !isModerator(RequestUser(c)) {
+        status = StoreStatus{Healthy: status.Healthy}
+    }
+    res.Content = status
+    return c.JSON(res.StatusCode, res)
 }
 
-// DB Access Functions
-func FindAllGroups(res *ResponseTemplate) (Groups, error) {
-    var groups Groups
-    rC := RedisConnection()
-    defer rC.Close()
+func GetGroups(c *echo.Context) error {
+    res := NewResponseTemplate()
 
-    groupKeys, err := rC.Do("KEYS", "group:*")
-    ErrorHandler(err)
+    q, err := ListQueryParams(c)
+    if err != nil {
+        return err
+    }
 
-    for _, k := range groupKeys.([]interface{}) {
-        var group Group
+    groups, page, err := FindListedGroups(RequestUser(c), q)
+    if err != nil {
+        return err
+    }
 
-        result, err := rC.Do("GET", k.([]byte))
-        ErrorHandler(err) // TODO: handle error here or return error code?
+    res.Content = groups
+    res.Page = &page
+    return c.JSON(res.StatusCode, res)
+}
 
-        if err := json.Unmarshal(result.([]byte), &group); err != nil {
-            ErrorHandler(err)
-        }
-        groups = append(groups, group)
+func GetGroup(c *echo.Context) error {
+    res := NewResponseTemplate()
+    group, err := FindGroupParam(c)
+    if err != nil {
+        return err
     }
 
-    return groups, nil
+    res.Content = group
+    return c.JSON(res.StatusCode, res)
 }
 
-func FindGroupGifs(res *http.Request, groupId int) (Gifs, error) {
-    var gifs Gifs
-    rC := RedisConnection()
-    defer rC.Close()
+func GetGroupGifs(c *echo.Context) error {
+    res := NewResponseTemplate()
+    group, err := FindGroupParam(c)
+    if err != nil {
+        return err
+    }
+
+    q, err := ListQueryParams(c)
+    if err != nil {
+        return err
+    }
 
-    gifKeys, err := rC.Do("SMEMBERS", "gifsForGroup:"+strconv.Itoa(groupId))
-    ErrorHandler(err)
+    gifs, page, err := FindVisibleGifs(RequestUser(c), group, q)
+    if err != nil {
+        return err
+    }
 
-    for _, k := range gifKeys.([]interface{}) {
-        var gif Gif
+    res.Content = gifs
+    res.Page = &page
+    return c.JSON(res.StatusCode, res)
+}
 
-        result, err := rC.Do("GET", k.([]byte))
-        ErrorHandler(err) // TODO: handle error here?
+func GetGroupLeaderboard(c *echo.Context) error {
+    res := NewResponseTemplate()
+    group, err := FindGroupParam(c)
+    if err != nil {
+        return err
+    }
 
-        if err := json.Unmarshal(result.([]byte), &gif); err != nil {
-            ErrorHandler(err)
+    limit := DefaultLeaderboardLimit
+    if l := c.Query("limit"); len(l) > 0 {
+        limit, err = strconv.Atoi(l)
+        if err != nil || limit < 1 || limit > MaxListLimit {
+            return NewBadRequestError(ErrCodeInvalidQuery, fmt.Sprintf("limit must be between 1 and %v", MaxListLimit), err)
         }
+    }
 
-        gifs = append(gifs, gif)
+    gifs, err := FindVisibleLeaders(RequestUser(c), group, limit)
+    if err != nil {
+        return err
     }
 
-    return gifs, nil
+    res.Content = gifs
+    return c.JSON(res.StatusCode, res)
 }
 
-func SaveGroup(g *Group, res *ResponseTemplate) error {
-    rC := RedisConnection()
-    defer rC.Close()
+func GetGroupExport(c *echo.Context) error {
+    group, err := FindGroupParam(c)
+    if err != nil {
+        return err
+    }
 
-    gJson, err := json.Marshal(g)
-    ErrorHandler(err)
+    gifs, err := AllGroupGifs(group.Id)
+    if err != nil {
+        return err
+    }
+    gifs = VisibleGifs(RequestUser(c), gifs, group)
+
+    // Once the archive starts streaming the status can no longer change, so
+    // a failure part way through can only cut the download short.
+    res := c.Response()
+    res.Header().Set("Content-Type", "application/zip")
+    res.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="group-%v.zip"`, group.Id))
+    res.WriteHeader(http.StatusOK)
+    return WriteArchive(zip.NewWriter(res), NewManifest(group, gifs))
+}
 
-    _, err = rC.Do("SET", "group:"+strconv.Itoa(g.Id), gJson)
+func PostGroups(c *echo.Context) error {
+    res := NewResponseTemplate()
+    user, err := CurrentUser(c)
     if err != nil {
-        SetInternalServerError(res, 1, "Error saving group")
         return err
     }
 
-    reply, err := redis.Int(rC.Do("INCR", "id:groups"))
+    groupId, err := store.NextGroupId()
     if err != nil {
-        SetInternalServerError(res, 1, "Error incrementing id:groups count")
         return err
     }
 
-    groupSeq = reply
-    return nil
-}
+    group := &Group{}
+    group.Id = groupId
+    group.OwnerId = user.Id
+    group.CreatedAt = time.Now().UTC()
+
+    uploaded, err := SaveGroupImage(c.Request(), group)
+    if err != nil {
+        return err
+    }
+
+    if group.Name = "Unnamed Group"; len(c.Form("name")) > 0 {
+        group.Name = c.Form("name")
+    }
 
-func SaveGroupImage(req *http.Request, g *Group, res *ResponseTemplate) error {
-    bucket := S3Bucket()
-    req.ParseMultipartForm(16 << 20)
+    if group.Visibility = VisibilityPublic; len(c.Form("visibility")) > 0 {
+        group.Visibility = c.Form("visibility")
+    }
+    if !ValidVisibility(group.Visibility) {
+        if uploaded {
+            ReleaseObject(group.ImageKey)
+        }
+        return invalidVisibilityError()
+    }
 
-    image, header, err := req.FormFile("image")
+    err = store.SaveGroup(group)
     if err != nil {
-        g.ImageUrl = bucket.URL("default/group-default.gif")
-        return nil
+        if uploaded {
+            ReleaseObject(group.ImageKey)
+        }
+        return err
     }
 
-    content, err := ioutil.ReadAll(image)
+    res.Content = group
+    return c.JSON(res.StatusCode, res)
+}
+
+func PostGroupImport(c *echo.Context) error {
+    res := NewResponseTemplate()
+    user, err := CurrentUser(c)
     if err != nil {
-        SetBadRequestError(res, 4, "Invalid or missing image")
         return err
     }
 
-    path := fmt.Sprintf("groups/%v/%v", g.Id, header.Filename)
+    files, err := ReadArchive(c.Request(), "archive")
+    if err != nil {
+        return err
+    }
 
-    err = bucket.Put(path, content, req.Header.Get("Content-Type"), s3.PublicRead)
+    manifest, byName, err := ReadManifest(files)
     if err != nil {
-        SetInternalServerError(res, 2, "Error uploading image to bucket")
         return err
     }
 
-    g.ImageUrl = bucket.URL(path)
-    return nil
-}
+    groupId, err := store.NextGroupId()
+    if err != nil {
+        return err
+    }
 
-func SaveGif(gif *Gif, res *ResponseTemplate) error {
-    rC := RedisConnection()
-    defer rC.Close()
+    group := &Group{}
+    group.Id = groupId
+    group.OwnerId = user.Id
+    if group.Name = "Unnamed Group"; len(manifest.Group.Name) > 0 {
+        group.Name = manifest.Group.Name
+    }
+    if group.Visibility = VisibilityPublic; ValidVisibility(manifest.Group.Visibility) {
+        group.Visibility = manifest.Group.Visibility
+    }
+    if group.CreatedAt = manifest.Group.CreatedAt; group.CreatedAt.IsZero() {
+        group.CreatedAt = time.Now().UTC()
+    }
 
-    gifJson, err := json.Marshal(gif)
-    ErrorHandler(err)
+    err = SaveImportedCover(group, byName[manifest.Cover])
+    if err != nil {
+        return err
+    }
 
-    _, err = rC.Do("SET", "gif:"+strconv.Itoa(gif.Id), gifJson)
+    err = store.SaveGroup(group)
     if err != nil {
-        SetInternalServerError(res, 1, "Error saving group")
+        if len(group.ImageKey) > 0 {
+            ReleaseObject(group.ImageKey)
+        }
         return err
     }
 
-    _, err = rC.Do("SADD", "gifsForGroup:"+strconv.Itoa(gif.GroupId), "gif:"+strconv.Itoa(gif.Id))
-    reply, err := redis.Int(rC.Do("INCR", "id:gifs"))
+    results, err := ImportGifs(group, manifest, byName)
     if err != nil {
-        SetInternalServerError(res, 1, "Error incrementing id:groups count")
         return err
     }
 
-    gifSeq = reply
-    return nil
+    res.Content = ImportResult{Group: group, Gifs: results}
+    return c.JSON(res.StatusCode, res)
 }
 
-func SaveGifToGroup(req *http.Request, g *Gif, res *ResponseTemplate) error {
-    bucket := S3Bucket()
-    req.ParseMultipartForm(16 << 20)
+func PatchGroup(c *echo.Context) error {
+    res := NewResponseTemplate()
+    group, err := FindGroupParam(c)
+    if err != nil {
+        return err
+    }
+
+    err = CheckEditGroup(RequestUser(c), group)
+    if err != nil {
+        return err
+    }
+
+    previousKey := group.ImageKey
+    uploaded, err := SaveGroupImage(c.Request(), group)
+    if err != nil {
+        return err
+    }
+
+    if len(c.Form("name")) > 0 {
+        group.Name = c.Form("name")
+    }
+
+    if len(c.Form("visibility")) > 0 {
+        group.Visibility = c.Form("visibility")
+        if !ValidVisibility(group.Visibility) {
+            if uploaded {
+                ReleaseObject(group.ImageKey)
+            }
+            return invalidVisibilityError()
+        }
+    }
 
-    image, header, err := req.FormFile("image")
+    err = store.SaveGroup(group)
     if err != nil {
-        SetBadRequestError(res, 4, "Invalid or missing image")
+        if uploaded {
+            ReleaseObject(group.ImageKey)
+        }
         return err
     }
 
-    content, err := ioutil.ReadAll(image)
+    if uploaded && len(previousKey) > 0 {
+        err = ReleaseObject(previousKey)
+        if err != nil {
+            return err
+        }
+    }
+
+    res.Content = group
+    return c.JSON(res.StatusCode, res)
+}
+
+func DeleteGroup(c *echo.Context) error {
+    res := NewResponseTemplate()
+    group, err := FindGroupParam(c)
     if err != nil {
-        SetBadRequestError(res, 4, "Invalid or missing image")
         return err
     }
 
-    path := fmt.Sprintf("groups/%v/gifs/%v", g.GroupId, header.Filename)
+    err = CheckEditGroup(RequestUser(c), group)
+    if err != nil {
+        return err
+    }
 
-    err = bucket.Put(path, content, req.Header.Get("Content-Type"), s3.PublicRead)
+    gifs, err := AllGroupGifs(group.Id)
     if err != nil {
-        SetInternalServerError(res, 2, "Error uploading image to bucket")
         return err
     }
 
-    g.ImageUrl = bucket.URL(path)
+    err = store.DeleteGroup(group.Id)
+    if err != nil {
+        return err
+    }
 
+    for _, gif := range gifs {
+        err = ReleaseGifImage(&gif)
+        if err != nil {
+            return err
+        }
+    }
+    if len(group.ImageKey) > 0 {
+        err = ReleaseObject(group.ImageKey)
+        if err != nil {
+            return err
+        }
+    }
+
+    // images saved before content-addressed keys live under the group
+    err = blobs.DeletePrefix(fmt.Sprintf("groups/%v/", group.Id))
+    if err != nil {
+        return err
+    }
+
+    res.Content = group
+    return c.JSON(res.StatusCode, res)
+}
+
+func PostGroupGif(c *echo.Context) error {
+    res := NewResponseTemplate()
+    user, err := CurrentUser(c)
+    if err != nil {
+        return err
+    }
+
+    group, err := FindGroupParam(c)
+    if err != nil {
+        return err
+    }
+
+    err = CheckAddGif(user, group)
+    if err != nil {
+        return err
+    }
+
+    gifId, err := store.NextGifId()
+    if err != nil {
+        return err
+    }
+
+    gif := &Gif{}
+    gif.Id = gifId
+    gif.GroupId = group.Id
+    gif.OwnerId = user.Id
+    gif.CreatedAt = time.Now().UTC()
+
+    res.Warnings, err = SaveGifToGroup(c.Request(), gif)
+    if err != nil {
+        return err
+    }
+
+    err = store.SaveGif(gif)
+    if err != nil {
+        ReleaseObject(gif.ImageKey)
+        return err
+    }
+
+    res.Content = gif
+    return c.JSON(res.StatusCode, res)
+}
+
+func PostGroupGifsBulk(c *echo.Context) error {
+    res := NewResponseTemplate()
+    user, err := CurrentUser(c)
+    if err != nil {
+        return err
+    }
+
+    group, err := FindGroupParam(c)
+    if err != nil {
+        return err
+    }
+
+    err = CheckAddGif(user, group)
+    if err != nil {
+        return err
+    }
+
+    files, err := ReadArchive(c.Request(), "archive")
+    if err != nil {
+        return err
+    }
+
+    known, err := LoadGroupGifs(group.Id)
+    if err != nil {
+        return err
+    }
+
+    // A server error stops the upload, but the files already stored are
+    // still reported, so a client retrying knows what the first attempt did.
+    results := []BulkResult{}
+    for _, file := range files {
+        result, err := SaveArchivedGif(group, known, user.Id, file, path.Base(file.Name), time.Now().UTC(), true)
+        results = append(results, result)
+        if err != nil {
+            log.Println(err)
+            SetError(res, AsAppError(err))
+            break
+        }
+    }
+
+    res.Content = results
+    return c.JSON(res.StatusCode, res)
+}
+
+func PostGroupGifUpload(c *echo.Context) error {
+    res := NewResponseTemplate()
+    user, err := CurrentUser(c)
+    if err != nil {
+        return err
+    }
+
+    group, err := FindGroupParam(c)
+    if err != nil {
+        return err
+    }
+
+    err = CheckAddGif(user, group)
+    if err != nil {
+        return err
+    }
+
+    upload, err := NewPendingUpload(group.Id, user.Id, c.Form("filename"))
+    if err != nil {
+        return err
+    }
+
+    res.Content = upload
+    return c.JSON(res.StatusCode, res)
+}
+
+func PostGroupGifUploadComplete(c *echo.Context) error {
+    res := NewResponseTemplate()
+    user, err := CurrentUser(c)
+    if err != nil {
+        return err
+    }
+
+    group, err := FindGroupParam(c)
+    if err != nil {
+        return err
+    }
+
+    err = CheckAddGif(user, group)
+    if err != nil {
+        return err
+    }
+
+    pending, err := store.FindPendingUpload(c.Param("upload_id"))
+    if err != nil {
+        return err
+    }
+    if pending.GroupId != group.Id || pending.UserId != user.Id {
+        return NewNotFoundError("Upload not found")
+    }
+
+    upload, err := NewStoredUpload(pending)
+    if err != nil {
+        return err
+    }
+    defer upload.Discard()
+
+    // Only one completion of the upload may create a gif
+    claimed, err := store.DeletePendingUpload(pending.Id)
+    if err != nil {
+        return err
+    }
+    if !claimed {
+        return NewNotFoundError("Upload not found")
+    }
+
+    // The copy validated above is what gets stored, so nothing the client
+    // uploads from now on is ever read.
+    blobs.Delete(pending.Path())
+
+    gifId, err := store.NextGifId()
+    if err != nil {
+        return err
+    }
+
+    gif := &Gif{}
+    gif.Id = gifId
+    gif.GroupId = group.Id
+    gif.OwnerId = user.Id
+    gif.CreatedAt = time.Now().UTC()
+
+    res.Warnings, err = SaveGifUpload(gif, upload)
+    if err != nil {
+        return err
+    }
+
+    err = store.SaveGif(gif)
+    if err != nil {
+        ReleaseObject(gif.ImageKey)
+        return err
+    }
+
+    res.Content = gif
+    return c.JSON(res.StatusCode, res)
+}
+
+func GetGif(c *echo.Context) error {
+    res := NewResponseTemplate()
+    gif, _, err := FindGifParam(c)
+    if err != nil {
+        return err
+    }
+
+    res.Content = gif
+    return c.JSON(res.StatusCode, res)
+}
+
+// GetGifDuplicates compares every gif in the library with every other, so
+// only moderators may run it.
+func GetGifDuplicates(c *echo.Context) error {
+    res := NewResponseTemplate()
+    user, err := CurrentUser(c)
+    if err != nil {
+        return err
+    }
+
+    err = CheckModerate(user)
+    if err != nil {
+        return err
+    }
+
+    gifs, err := AllGifs(user)
+    if err != nil {
+        return err
+    }
+
+    res.Content = ClusterDuplicates(gifs)
+    return c.JSON(res.StatusCode, res)
+}
+
+func DeleteGif(c *echo.Context) error {
+    res := NewResponseTemplate()
+    gif, group, err := FindGifParam(c)
+    if err != nil {
+        return err
+    }
+
+    err = CheckRemoveGif(RequestUser(c), gif, group)
+    if err != nil {
+        return err
+    }
+
+    err = store.DeleteGif(gif)
+    if err != nil {
+        return err
+    }
+
+    err = ReleaseGifImage(gif)
+    if err != nil {
+        return err
+    }
+
+    res.Content = gif
+    return c.JSON(res.StatusCode, res)
+}
+
+func PostGifMove(c *echo.Context) error {
+    res := NewResponseTemplate()
+    gif, from, err := FindGifParam(c)
+    if err != nil {
+        return err
+    }
+
+    user := RequestUser(c)
+    err = CheckRemoveGif(user, gif, from)
+    if err != nil {
+        return err
+    }
+
+    groupId, err := strconv.Atoi(c.Form("group_id"))
+    if err != nil {
+        return NewBadRequestError(ErrCodeInvalidForm, "Invalid or missing group_id", err)
+    }
+
+    group, err := FindVisibleGroup(user, groupId)
+    if err != nil {
+        return err
+    }
+
+    err = CheckAddGif(user, group)
+    if err != nil {
+        return err
+    }
+
+    if gif.GroupId != group.Id {
+        from := GifBlobPaths(gif)
+        err = MoveGifImage(gif, group.Id)
+        if err != nil {
+            return err
+        }
+
+        err = store.MoveGif(gif, group.Id)
+        if err != nil {
+            return err
+        }
+
+        err = DeleteBlobs(from)
+        if err != nil {
+            return err
+        }
+    }
+
+    res.Content = gif
+    return c.JSON(res.StatusCode, res)
+}
+
+func GetGroupMembers(c *echo.Context) error {
+    res := NewResponseTemplate()
+    user, err := CurrentUser(c)
+    if err != nil {
+        return err
+    }
+
+    group, err := FindGroupParam(c)
+    if err != nil {
+        return err
+    }
+
+    err = CheckListMembers(user, group)
+    if err != nil {
+        return err
+    }
+
+    members, err := FindGroupMembers(group)
+    if err != nil {
+        return err
+    }
+
+    res.Content = members
+    return c.JSON(res.StatusCode, res)
+}
+
+func DeleteGroupMember(c *echo.Context) error {
+    res := NewResponseTemplate()
+    user, err := CurrentUser(c)
+    if err != nil {
+        return err
+    }
+
+    group, err := FindGroupParam(c)
+    if err != nil {
+        return err
+    }
+
+    memberId, err := strconv.Atoi(c.Param("user_id"))
+    if err != nil {
+        return NewBadRequestError(ErrCodeInvalidId, "Invalid user_id", err)
+    }
+
+    // Members may leave; only the owner and admins may remove others
+    if memberId != user.Id {
+        err = CheckEditGroup(user, group)
+        if err != nil {
+            return err
+        }
+    }
+    if memberId == group.OwnerId {
+        return NewBadRequestError(ErrCodeInvalidForm, "The owner can't be removed from their group", nil)
+    }
+
+    err = store.RemoveGroupMember(group.Id, memberId)
+    if err != nil {
+        return err
+    }
+
+    return c.JSON(res.StatusCode, res)
+}
+
+func PostGroupInvite(c *echo.Context) error {
+    res := NewResponseTemplate()
+    user, err := CurrentUser(c)
+    if err != nil {
+        return err
+    }
+
+    group, err := FindGroupParam(c)
+    if err != nil {
+        return err
+    }
+
+    err = CheckEditGroup(user, group)
+    if err != nil {
+        return err
+    }
+
+    invite, err := NewInvite(group, user)
+    if err != nil {
+        return err
+    }
+
+    res.Content = invite
+    return c.JSON(res.StatusCode, res)
+}
+
+func DeleteGroupInvite(c *echo.Context) error {
+    res := NewResponseTemplate()
+    group, err := FindGroupParam(c)
+    if err != nil {
+        return err
+    }
+
+    err = CheckEditGroup(RequestUser(c), group)
+    if err != nil {
+        return err
+    }
+
+    invite, err := store.FindInvite(c.Param("code"))
+    if err != nil {
+        return err
+    }
+    if invite.GroupId != group.Id {
+        return NewNotFoundError("Invite not found")
+    }
+
+    err = store.DeleteInvite(invite.Code)
+    if err != nil {
+        return err
+    }
+
+    return c.JSON(res.StatusCode, res)
+}
+
+func PostInviteAccept(c *echo.Context) error {
+    res := NewResponseTemplate()
+    user, err := CurrentUser(c)
+    if err != nil {
+        return err
+    }
+
+    invite, err := store.FindInvite(c.Param("code"))
+    if err != nil {
+        return err
+    }
+
+    // Not FindVisibleGroup: the invite is what lets the user see a private
+    // group. Hidden groups stay hidden, though.
+    group, err := store.FindGroup(invite.GroupId)
+    if appErr, ok := err.(*AppError); ok && appErr.Code == ErrCodeNotFound {
+        return NewNotFoundError("Invite not found")
+    }
+    if err != nil {
+        return err
+    }
+    if group.Hidden && !isModerator(user) {
+        return NewNotFoundError("Invite not found")
+    }
+
+    err = store.AddGroupMember(group.Id, user.Id)
+    if err != nil {
+        return err
+    }
+
+    res.Content = group
+    return c.JSON(res.StatusCode, res)
+}
+
+func PostGroupHide(c *echo.Context) error {
+    return SetGroupHidden(c, true)
+}
+
+func PostGroupUnhide(c *echo.Context) error {
+    return SetGroupHidden(c, false)
+}
+
+func PostGifVote(c *echo.Context) error {
+    vote, err := ParseVote(c.Form("vote"))
+    if err != nil {
+        return err
+    }
+    return SetGifVote(c, vote)
+}
+
+func DeleteGifVote(c *echo.Context) error {
+    return SetGifVote(c, 0)
+}
+
+func PostGifHide(c *echo.Context) error {
+    return SetGifHidden(c, true)
+}
+
+func PostGifUnhide(c *echo.Context) error {
+    return SetGifHidden(c, false)
+}
+
+// Util Functions
+
+// SetGroupHidden hides or unhides the group named by the :id route parameter.
+func SetGroupHidden(c *echo.Context, hidden bool) error {
+    res := NewResponseTemplate()
+    err := CheckModerate(RequestUser(c))
+    if err != nil {
+        return err
+    }
+
+    group, err := FindGroupParam(c)
+    if err != nil {
+        return err
+    }
+
+    group.Hidden = hidden
+    err = store.SaveGroup(group)
+    if err != nil {
+        return err
+    }
+
+    res.Content = group
+    return c.JSON(res.StatusCode, res)
+}
+
+// SetGifHidden hides or unhides the gif named by the :id route parameter.
+func SetGifHidden(c *echo.Context, hidden bool) error {
+    res := NewResponseTemplate()
+    err := CheckModerate(RequestUser(c))
+    if err != nil {
+        return err
+    }
+
+    gif, _, err := FindGifParam(c)
+    if err != nil {
+        return err
+    }
+
+    gif.Hidden = hidden
+    err = store.SaveGif(gif)
+    if err != nil {
+        return err
+    }
+
+    res.Content = gif
+    return c.JSON(res.StatusCode, res)
+}
+
+// SetGifVote records the current user's vote on the gif named by the :id
+// route parameter, or withdraws it when vote is 0.
+func SetGifVote(c *echo.Context, vote int) error {
+    res := NewResponseTemplate()
+    user, err := CurrentUser(c)
+    if err != nil {
+        return err
+    }
+
+    gif, _, err := FindGifParam(c)
+    if err != nil {
+        return err
+    }
+
+    err = store.VoteGif(gif, user.Id, vote)
+    if err != nil {
+        return err
+    }
+
+    res.Content = gif
+    return c.JSON(res.StatusCode, res)
+}
+
+// IdParam parses the :id route parameter.
+func IdParam(c *echo.Context) (int, error) {
+    id, err := strconv.Atoi(c.Param("id"))
+    if err != nil || id < 1 {
+        return 0, NewBadRequestError(ErrCodeInvalidId, "Invalid id", err)
+    }
+    return id, nil
+}
+
+// ListQueryParams reads the limit, cursor, sort and order query parameters of
+// a list endpoint.
+func ListQueryParams(c *echo.Context) (ListQuery, error) {
+    q := ListQuery{Limit: DefaultListLimit, Sort: SortById}
+
+    if limit := c.Query("limit"); len(limit) > 0 {
+        l, err := strconv.Atoi(limit)
+        if err != nil || l < 1 || l > MaxListLimit {
+            return q, NewBadRequestError(ErrCodeInvalidQuery, fmt.Sprintf("limit must be between 1 and %v", MaxListLimit), err)
+        }
+        q.Limit = l
+    }
+
+    switch c.Query("sort") {
+    case "", SortById:
+    case SortByCreated:
+        q.Sort = SortByCreated
+    default:
+        return q, NewBadRequestError(ErrCodeInvalidQuery, "sort must be id or created", nil)
+    }
+
+    switch c.Query("order") {
+    case "", "asc":
+    case "desc":
+        q.Desc = true
+    default:
+        return q, NewBadRequestError(ErrCodeInvalidQuery, "order must be asc or desc", nil)
+    }
+
+    if err := q.ParseCursor(c.Query("cursor")); err != nil {
+        return q, NewBadRequestError(ErrCodeInvalidQuery, "Invalid cursor", err)
+    }
+
+    return q, nil
+}
+
+// FindGifParam returns the gif named by the :id route parameter, and its
+// group. Gifs the user making the request can't see are not found.
+func FindGifParam(c *echo.Context) (*Gif, *Group, error) {
+    id, err := IdParam(c)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    gif, err := store.FindGif(id)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    group, err := store.FindGroup(gif.GroupId)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    user := RequestUser(c)
+    visible, err := CanSeeGroup(user, group)
+    if err != nil {
+        return nil, nil, err
+    }
+    if !visible || !CanSeeGif(user, gif, group) {
+        return nil, nil, NewNotFoundError("Gif not found")
+    }
+    return gif, group, nil
+}
+
+// FindGroupParam returns the group named by the :id route parameter. Groups
+// the user making the request can't see are not found.
+func FindGroupParam(c *echo.Context) (*Group, error) {
+    id, err := IdParam(c)
+    if err != nil {
+        return nil, err
+    }
+    return FindVisibleGroup(RequestUser(c), id)
+}
+
+// FindVisibleGroup returns the group with the given id, unless u can't see it.
+func FindVisibleGroup(u *User, id int) (*Group, error) {
+    group, err := store.FindGroup(id)
+    if err != nil {
+        return nil, err
+    }
+
+    visible, err := CanSeeGroup(u, group)
+    if err != nil {
+        return nil, err
+    }
+    if !visible {
+        return nil, NewNotFoundError("Group not found")
+    }
+    return group, nil
+}
+
+// AllGroupGifs returns every gif in the group, reading the list page by page.
+func AllGroupGifs(groupId int) (Gifs, error) {
+    all := Gifs{}
+    q := ListQuery{Limit: MaxListLimit, Sort: SortById}
+    for {
+        gifs, page, err := store.FindGroupGifs(groupId, q)
+        if err != nil {
+            return nil, err
+        }
+        all = append(all, gifs...)
+
+        if len(page.NextCursor) == 0 {
+            return all, nil
+        }
+        err = q.ParseCursor(page.NextCursor)
+        if err != nil {
+            return nil, NewInternalError(ErrCodeInternal, "Error listing gifs", err)
+        }
+    }
+}
+
+// AllGifs returns every gif that u can see in the groups u can list.
+func AllGifs(u *User) (Gifs, error) {
+    all := Gifs{}
+    q := ListQuery{Limit: MaxListLimit, Sort: SortById}
+    for {
+        groups, page, err := store.FindAllGroups(q)
+        if err != nil {
+            return nil, err
+        }
+        groups, err = ListedGroups(u, groups)
+        if err != nil {
+            return nil, err
+        }
+        for _, group := range groups {
+            gifs, err := AllGroupGifs(group.Id)
+            if err != nil {
+                return nil, err
+            }
+            all = append(all, VisibleGifs(u, gifs, &group)...)
+        }
+
+        if len(page.NextCursor) == 0 {
+            return all, nil
+        }
+        err = q.ParseCursor(page.NextCursor)
+        if err != nil {
+            return nil, NewInternalError(ErrCodeInternal, "Error listing groups", err)
+        }
+    }
+}
+
+func invalidVisibilityError() error {
+    return NewBadRequestError(ErrCodeInvalidForm, "visibility must be public, unlisted or private", nil)
+}
+
+// ErrorHandler panics on err. It is only meant for startup, where there is no
+// request to report the error to; route functions return an AppError instead.
+func ErrorHandler(err error) {
+    if err != nil {
+        panic(err)
+    }
+}
+
+func envOr(key, fallback string) string {
+    if value := os.Getenv(key); len(value) > 0 {
+        return value
+    }
+    return fallback
+}
+
+func envInt(key string, fallback int) int {
+    value := os.Getenv(key)
+    if len(value) == 0 {
+        return fallback
+    }
+
+    i, err := strconv.Atoi(value)
+    ErrorHandler(err)
+    return i
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+    value := os.Getenv(key)
+    if len(value) == 0 {
+        return fallback
+    }
+
+    d, err := time.ParseDuration(value)
+    ErrorHandler(err)
+    return d
+}
+
+func NewResponseTemplate() *ResponseTemplate {
+    template := &ResponseTemplate{}
+    template.Success = true
+    template.StatusCode = http.StatusOK
+    template.StatusText = http.StatusText(http.StatusOK)
+    template.ErrorCode = 0
+    template.ErrorText = "No Error"
+    return template
+}
+
+// Storage Functions
+
+// SaveGroupImage stores the image uploaded with the request, if any, as the
+// group's image and reports whether there was one. The rest of the form can
+// only be read once it has been called.
+func SaveGroupImage(req *http.Request, g *Group) (bool, error) {
+    upload, err := StreamUpload(req, "image")
+    if err != nil {
+        return false, err
+    }
+    defer upload.Discard()
+
+    if upload == nil {
+        if len(g.ImageUrl) == 0 { // keep the current image when updating
+            g.ImageUrl = blobs.URL(defaultGroupImage)
+        }
+        return false, nil
+    }
+
+    g.ImageKey, err = SaveObject(upload)
+    if err != nil {
+        return false, err
+    }
+
+    g.ImageUrl, g.PosterUrl, g.PreviewUrl = ObjectUrls(g.ImageKey)
+    return true, nil
+}
+
+// SaveGifToGroup stores the image sent with the request, either uploaded or
+// named by a source_url, as the image of g, a new gif in its group.
+func SaveGifToGroup(req *http.Request, g *Gif) ([]string, error) {
+    if IsJSON(req) {
+        content, filename, err := ReadSourceUrl(req)
+        if err != nil {
+            return nil, err
+        }
+        return SaveGifContent(g, content, filename)
+    }
+
+    upload, err := StreamUpload(req, "image")
+    if err != nil {
+        return nil, err
+    }
+    defer upload.Discard()
+
+    if upload == nil {
+        return nil, NewBadRequestError(ErrCodeInvalidForm, "Invalid or missing image", nil)
+    }
+    return SaveGifUpload(g, upload)
+}
+
+// SaveGifContent validates content as the image of g, a new gif in its
+// group, and stores it. It returns any duplicate warnings for the client.
+func SaveGifContent(g *Gif, content []byte, filename string) ([]string, error) {
+    upload, err := NewUpload(content, filename)
+    if err != nil {
+        return nil, err
+    }
+    return SaveGifUpload(g, upload)
+}
+
+// SaveGifUpload stores u as the image of g, a new gif in its group, after
+// checking it for duplicates among the gifs in the group.
+func SaveGifUpload(g *Gif, u *Upload) ([]string, error) {
+    var candidates Gifs
+    if duplicatePolicy.Action != DuplicateAllow {
+        var err error
+        candidates, err = AllGroupGifs(g.GroupId)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return SaveGifUploadAmong(g, u, candidates)
+}
+
+// SaveGifUploadAmong is SaveGifUpload for callers that already hold the gifs
+// in the group, as candidates.
+func SaveGifUploadAmong(g *Gif, u *Upload, candidates Gifs) ([]string, error) {
+    SetGifMetadata(g, u)
+    g.Filename = u.Filename
+
+    warnings, err := CheckDuplicates(g, candidates)
+    if err != nil {
+        return nil, err
+    }
+
+    g.ImageKey, err = SaveObject(u)
+    if err != nil {
+        return nil, err
+    }
+
+    g.ImageUrl, g.PosterUrl, g.PreviewUrl = ObjectUrls(g.ImageKey)
+
+    return warnings, nil
+}
+
+// GroupImagePath returns where the group's own image is kept in blob storage,
+// or "" if it uses the default image.
+func GroupImagePath(g *Group) string {
+    if len(g.ImageKey) > 0 {
+        return g.ImageKey
+    }
+    if len(g.ImageUrl) == 0 || g.ImageUrl == blobs.URL(defaultGroupImage) {
+        return ""
+    }
+    return fmt.Sprintf("groups/%v/%v", g.Id, path.Base(g.ImageUrl))
+}
+
+// GifFilePath returns where the gif's image is kept in blob storage.
+func GifFilePath(g *Gif) string {
+    if len(g.ImageKey) > 0 {
+        return g.ImageKey
+    }
+    return GifImagePath(g)
+}
+
+// ReleaseGifImage lets go of the gif's image once the gif is deleted.
+func ReleaseGifImage(g *Gif) error {
+    if len(g.ImageKey) > 0 {
+        return ReleaseObject(g.ImageKey)
+    }
+    return DeleteBlobs(GifBlobPaths(g))
+}
+
+// GifImagePath returns where the image of a gif saved before content-addressed
+// keys is kept in blob storage.
+func GifImagePath(g *Gif) string {
+    filename := g.Filename
+    if len(filename) == 0 { // saved before filenames were recorded
+        filename = path.Base(g.ImageUrl)
+    }
+    return fmt.Sprintf("groups/%v/gifs/%v", g.GroupId, filename)
+}
+
+// GifBlobPaths returns the files kept for the gif alone: its image and, for
+// gifs uploaded since they were introduced, its renditions. Gifs with an
+// ImageKey share their files with identical uploads, and have none.
+func GifBlobPaths(g *Gif) []string {
+    if len(g.ImageKey) > 0 {
+        return nil
+    }
+
+    image := GifImagePath(g)
+    if len(g.PosterUrl) == 0 {
+        return []string{image}
+    }
+    return []string{image, PosterPath(image), PreviewPath(image)}
+}
+
+// DeleteBlobs removes every file at paths.
+func DeleteBlobs(paths []string) error {
+    for _, p := range paths {
+        err := blobs.Delete(p)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// MoveGifImage copies the files of a gif saved before content-addressed keys
+// to their paths under groupId and points the gif's URLs at the copies. The
+// originals are left in place for the caller to delete once the move is
+// saved. Content-addressed files don't depend on the group, and stay put.
+func MoveGifImage(g *Gif, groupId int) error {
+    if len(g.ImageKey) > 0 {
+        return nil
+    }
+
+    moved := *g
+    moved.GroupId = groupId
+    from, to := GifBlobPaths(g), GifBlobPaths(&moved)
+
+    for i := range from {
+        content, err := blobs.Get(from[i])
+        if err != nil {
+            return err
+        }
+
+        err = blobs.Put(to[i], content, mime.TypeByExtension(path.Ext(to[i])))
+        if err != nil {
+            return err
+        }
+    }
+
+    g.Filename = path.Base(to[0])
+    g.ImageUrl = blobs.URL(to[0])
+    if len(g.PosterUrl) > 0 {
+        g.PosterUrl = blobs.URL(to[1])
+        g.PreviewUrl = blobs.URL(to[2])
+    }
     return nil
 }
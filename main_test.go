@@ -0,0 +1,434 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "image"
+    "image/color"
+    "image/gif"
+    "mime/multipart"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strconv"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/garyburd/redigo/redis"
+    "github.com/labstack/echo"
+)
+
+// testRedisDB is the database the Redis tests use, away from development
+// data in database 0.
+const testRedisDB = 15
+
+// testGif encodes a small single frame GIF filled with c.
+func testGif(t *testing.T, c color.Color) []byte {
+    img := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, c})
+    for i := range img.Pix {
+        img.Pix[i] = 1
+    }
+
+    var b bytes.Buffer
+    if err := gif.Encode(&b, img, nil); err != nil {
+        t.Fatal(err)
+    }
+    return b.Bytes()
+}
+
+// testServer points the API at s and a local blob store in a temporary
+// directory, and returns a server for it along with the API key of a new
+// user.
+func testServer(t *testing.T, s GroupStore) (*echo.Echo, string) {
+    previousStore, previousBlobs := store, blobs
+    t.Cleanup(func() { store, blobs = previousStore, previousBlobs })
+
+    local, err := NewLocalBlobStore(t.TempDir(), "http://localhost"+localBlobRoute)
+    if err != nil {
+        t.Fatal(err)
+    }
+    store, blobs = s, local
+    _, apiKey := testUser(t, RolePlayer)
+
+    e := echo.New()
+    e.SetHTTPErrorHandler(HTTPErrorHandler)
+    AddRoutes(e)
+    return e, apiKey
+}
+
+// testUser registers a user with role in the store the server uses, and
+// returns them along with their API key.
+func testUser(t *testing.T, role string) (*User, string) {
+    user := &User{Name: role, Role: role, CreatedAt: time.Now().UTC()}
+    id, err := store.NextUserId()
+    if err == nil {
+        user.Id = id
+        err = store.SaveUser(user)
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    key, err := NewApiKey(user)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return user, key.ApiKey
+}
+
+// serve sends req to e, with apiKey unless it is empty, and decodes the
+// content of the response into content unless it is nil. It returns the
+// status code.
+func serve(t *testing.T, e *echo.Echo, req *http.Request, apiKey string, content interface{}) int {
+    if len(apiKey) > 0 {
+        req.Header.Set(ApiKeyHeader, apiKey)
+    }
+    rec := httptest.NewRecorder()
+    e.ServeHTTP(rec, req)
+
+    if content != nil {
+        res := struct {
+            Content interface{} `json:"content"`
+        }{content}
+        if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+            t.Fatalf("%v %v: %v", req.Method, req.URL, err)
+        }
+    }
+    return rec.Code
+}
+
+// getJSON sends a GET request for path, as serve does.
+func getJSON(t *testing.T, e *echo.Echo, apiKey, path string, content interface{}) int {
+    req, err := http.NewRequest("GET", path, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return serve(t, e, req, apiKey, content)
+}
+
+// sendForm sends a multipart form with fields, and an image field holding
+// image unless it is nil, as serve does.
+func sendForm(t *testing.T, e *echo.Echo, method, apiKey, path string, fields map[string]string, image []byte, content interface{}) int {
+    var body bytes.Buffer
+    w := multipart.NewWriter(&body)
+    for name, value := range fields {
+        w.WriteField(name, value)
+    }
+    if image != nil {
+        part, err := w.CreateFormFile("image", "test.gif")
+        if err == nil {
+            _, err = part.Write(image)
+        }
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := w.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    req, err := http.NewRequest(method, path, &body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("Content-Type", w.FormDataContentType())
+    return serve(t, e, req, apiKey, content)
+}
+
+// postForm sends a multipart form with an image field holding image, and
+// returns the id of the record created.
+func postForm(e *echo.Echo, apiKey, path string, fields map[string]string, image []byte) (int, error) {
+    var body bytes.Buffer
+    w := multipart.NewWriter(&body)
+    for name, value := range fields {
+        w.WriteField(name, value)
+    }
+    part, err := w.CreateFormFile("image", "test.gif")
+    if err == nil {
+        _, err = part.Write(image)
+    }
+    if err == nil {
+        err = w.Close()
+    }
+    if err != nil {
+        return 0, err
+    }
+
+    req, err := http.NewRequest("POST", path, &body)
+    if err != nil {
+        return 0, err
+    }
+    req.Header.Set("Content-Type", w.FormDataContentType())
+    req.Header.Set(ApiKeyHeader, apiKey)
+    rec := httptest.NewRecorder()
+    e.ServeHTTP(rec, req)
+
+    var res struct {
+        Content struct {
+            Id int `json:"id"`
+        } `json:"content"`
+        ErrorText string `json:"error_text"`
+    }
+    if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+        return 0, err
+    }
+    if rec.Code != http.StatusOK {
+        return 0, &AppError{Status: rec.Code, Message: res.ErrorText}
+    }
+    return res.Content.Id, nil
+}
+
+// hammerCreate creates groups and gifs all at once, and checks that no two
+// were given the same id.
+func hammerCreate(t *testing.T, s GroupStore) {
+    e, apiKey := testServer(t, s)
+    image := testGif(t, color.White)
+
+    groupId, err := postForm(e, apiKey, "/api/v1/groups", map[string]string{"name": "target"}, image)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    const n = 50
+    var wg sync.WaitGroup
+    groupIds, gifIds, errs := make(chan int, n), make(chan int, n), make(chan error, 2*n)
+    for i := 0; i < n; i++ {
+        wg.Add(2)
+        go func(i int) {
+            defer wg.Done()
+            id, err := postForm(e, apiKey, "/api/v1/groups", map[string]string{"name": "group " + strconv.Itoa(i)}, image)
+            if err != nil {
+                errs <- err
+                return
+            }
+            groupIds <- id
+        }(i)
+        go func() {
+            defer wg.Done()
+            id, err := postForm(e, apiKey, "/api/v1/groups/"+strconv.Itoa(groupId)+"/gifs", nil, image)
+            if err != nil {
+                errs <- err
+                return
+            }
+            gifIds <- id
+        }()
+    }
+    wg.Wait()
+    close(groupIds)
+    close(gifIds)
+    close(errs)
+
+    for err := range errs {
+        t.Error(err)
+    }
+    for name, ids := range map[string]chan int{"group": groupIds, "gif": gifIds} {
+        seen := map[int]bool{}
+        if name == "group" {
+            seen[groupId] = true
+        }
+        for id := range ids {
+            if seen[id] {
+                t.Errorf("%v id %v was given out twice", name, id)
+            }
+            seen[id] = true
+        }
+    }
+}
+
+// statusDetail checks that the store's details are only shown to operators.
+func statusDetail(t *testing.T, s GroupStore) {
+    e, apiKey := testServer(t, s)
+    _, moderatorKey := testUser(t, RoleModerator)
+
+    for _, key := range []string{"", apiKey} {
+        var status map[string]interface{}
+        if code := getJSON(t, e, key, "/api/v1/status", &status); code != http.StatusOK {
+            t.Fatalf("got status %v", code)
+        }
+        if len(status) != 1 || status["healthy"] != true {
+            t.Errorf("got status %v, want only healthy", status)
+        }
+    }
+
+    var status StoreStatus
+    getJSON(t, e, moderatorKey, "/api/v1/status", &status)
+    if len(status.Backend) == 0 || !status.Healthy {
+        t.Errorf("moderator got status %+v, want the backend", status)
+    }
+    if _, ok := s.(*RedisStore); ok && status.Pool == nil {
+        t.Error("moderator wasn't shown the Redis pool")
+    }
+}
+
+func TestStatusDetailMemory(t *testing.T) {
+    statusDetail(t, NewMemoryStore())
+}
+
+func TestStatusDetailRedis(t *testing.T) {
+    statusDetail(t, testRedisStore(t))
+}
+
+func TestConcurrentCreateMemory(t *testing.T) {
+    hammerCreate(t, NewMemoryStore())
+}
+
+// testRedisStore returns a store in testRedisDB of the Redis instance at
+// TEST_REDIS_ADDR, which every test empties. The address is never taken from
+// the server's own config, so the tests are skipped unless one is given for
+// them, as they are when Redis isn't reachable.
+func testRedisStore(t *testing.T) *RedisStore {
+    addr := os.Getenv("TEST_REDIS_ADDR")
+    if len(addr) == 0 {
+        t.Skip("TEST_REDIS_ADDR isn't set")
+    }
+    pool := &redis.Pool{
+        MaxIdle: 10,
+        Dial: func() (redis.Conn, error) {
+            return redis.Dial("tcp", addr, redis.DialConnectTimeout(time.Second), redis.DialDatabase(testRedisDB))
+        },
+    }
+    t.Cleanup(func() { pool.Close() })
+
+    // Each test starts from an empty database, so records left by earlier
+    // tests don't show up in its lists.
+    rC := pool.Get()
+    _, err := rC.Do("FLUSHDB")
+    rC.Close()
+    if err != nil {
+        t.Skipf("Redis isn't reachable at %v: %v", addr, err)
+    }
+    return NewRedisStore(pool)
+}
+
+func TestConcurrentCreateRedis(t *testing.T) {
+    hammerCreate(t, testRedisStore(t))
+}
+
+// groupLifecycle gets, renames and re-covers, and deletes a group, and checks
+// that deleting it takes its gifs and images with it.
+func groupLifecycle(t *testing.T, s GroupStore) {
+    e, apiKey := testServer(t, s)
+    groupId, err := postForm(e, apiKey, "/api/v1/groups", map[string]string{"name": "first"}, testGif(t, color.White))
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := "/api/v1/groups/" + strconv.Itoa(groupId)
+    gifId, err := postForm(e, apiKey, path+"/gifs", nil, testGif(t, color.RGBA{255, 0, 0, 255}))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var group Group
+    if code := getJSON(t, e, "", path, &group); code != http.StatusOK || group.Name != "first" {
+        t.Fatalf("got %v and group %+v, want the group", code, group)
+    }
+    firstCover := group.ImageKey
+
+    code := sendForm(t, e, "PATCH", apiKey, path, map[string]string{"name": "second"}, testGif(t, color.RGBA{0, 0, 255, 255}), &group)
+    if code != http.StatusOK || group.Name != "second" || group.ImageKey == firstCover {
+        t.Fatalf("PATCH got %v and group %+v, want it renamed with a new cover", code, group)
+    }
+    if exists, err := blobs.Exists(firstCover); err != nil || exists {
+        t.Errorf("replaced cover exists %v, error %v", exists, err)
+    }
+
+    var gif Gif
+    getJSON(t, e, "", "/api/v1/gifs/"+strconv.Itoa(gifId), &gif)
+
+    req, _ := http.NewRequest("DELETE", path, nil)
+    if code := serve(t, e, req, apiKey, nil); code != http.StatusOK {
+        t.Fatalf("DELETE got %v", code)
+    }
+    if code := getJSON(t, e, "", path, nil); code != http.StatusNotFound {
+        t.Errorf("deleted group got %v, want %v", code, http.StatusNotFound)
+    }
+    if code := getJSON(t, e, "", "/api/v1/gifs/"+strconv.Itoa(gifId), nil); code != http.StatusNotFound {
+        t.Errorf("gif of a deleted group got %v, want %v", code, http.StatusNotFound)
+    }
+    for _, key := range []string{group.ImageKey, gif.ImageKey} {
+        if exists, err := blobs.Exists(key); err != nil || exists {
+            t.Errorf("%v exists %v after deleting the group, error %v", key, exists, err)
+        }
+    }
+    if r, ok := s.(*RedisStore); ok {
+        rC := r.pool.Get()
+        defer rC.Close()
+        n, err := rC.Do("EXISTS", "group:"+strconv.Itoa(groupId), "gifsForGroup:"+strconv.Itoa(groupId), "gif:"+strconv.Itoa(gifId))
+        if err != nil || n != int64(0) {
+            t.Errorf("%v keys of the deleted group left behind, error %v", n, err)
+        }
+    }
+}
+
+func TestGroupLifecycleMemory(t *testing.T) {
+    groupLifecycle(t, NewMemoryStore())
+}
+
+func TestGroupLifecycleRedis(t *testing.T) {
+    groupLifecycle(t, testRedisStore(t))
+}
+
+// gifLifecycle gets a gif, moves it to another group and deletes it, and
+// checks that each group lists it only while it belongs there.
+func gifLifecycle(t *testing.T, s GroupStore) {
+    e, apiKey := testServer(t, s)
+    var groupIds [2]int
+    for i := range groupIds {
+        id, err := postForm(e, apiKey, "/api/v1/groups", map[string]string{"name": "group"}, testGif(t, color.White))
+        if err != nil {
+            t.Fatal(err)
+        }
+        groupIds[i] = id
+    }
+    gifId, err := postForm(e, apiKey, "/api/v1/groups/"+strconv.Itoa(groupIds[0])+"/gifs", nil, testGif(t, color.RGBA{255, 0, 0, 255}))
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := "/api/v1/gifs/" + strconv.Itoa(gifId)
+
+    // groupGifs returns the ids of the gifs in the group.
+    groupGifs := func(groupId int) []int {
+        var gifs Gifs
+        getJSON(t, e, "", "/api/v1/groups/"+strconv.Itoa(groupId)+"/gifs", &gifs)
+        ids := []int{}
+        for _, gif := range gifs {
+            ids = append(ids, gif.Id)
+        }
+        return ids
+    }
+
+    var gif Gif
+    if code := getJSON(t, e, "", path, &gif); code != http.StatusOK || gif.GroupId != groupIds[0] {
+        t.Fatalf("got %v and gif %+v, want the gif in group %v", code, gif, groupIds[0])
+    }
+
+    code := sendForm(t, e, "POST", apiKey, path+"/move", map[string]string{"group_id": strconv.Itoa(groupIds[1])}, nil, &gif)
+    if code != http.StatusOK || gif.GroupId != groupIds[1] {
+        t.Fatalf("move got %v and gif %+v, want it in group %v", code, gif, groupIds[1])
+    }
+    if from, to := groupGifs(groupIds[0]), groupGifs(groupIds[1]); len(from) != 0 || len(to) != 1 || to[0] != gifId {
+        t.Errorf("after the move the groups list gifs %v and %v, want none and %v", from, to, gifId)
+    }
+
+    req, _ := http.NewRequest("DELETE", path, nil)
+    if code := serve(t, e, req, apiKey, nil); code != http.StatusOK {
+        t.Fatalf("DELETE got %v", code)
+    }
+    if code := getJSON(t, e, "", path, nil); code != http.StatusNotFound {
+        t.Errorf("deleted gif got %v, want %v", code, http.StatusNotFound)
+    }
+    if ids := groupGifs(groupIds[1]); len(ids) != 0 {
+        t.Errorf("group still lists gifs %v after the delete", ids)
+    }
+    if exists, err := blobs.Exists(gif.ImageKey); err != nil || exists {
+        t.Errorf("deleted gif's image exists %v, error %v", exists, err)
+    }
+}
+
+func TestGifLifecycleMemory(t *testing.T) {
+    gifLifecycle(t, NewMemoryStore())
+}
+
+func TestGifLifecycleRedis(t *testing.T) {
+    gifLifecycle(t, testRedisStore(t))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "time"
+)
+
+const (
+    VisibilityPublic   = "public"
+    VisibilityUnlisted = "unlisted"
+    VisibilityPrivate  = "private"
+)
+
+// inviteTTL is how long invite codes can be accepted for.
+var inviteTTL = 7 * 24 * time.Hour
+
+// ValidVisibility reports whether visibility is one a group can be given.
+func ValidVisibility(visibility string) bool {
+    switch visibility {
+    case VisibilityPublic, VisibilityUnlisted, VisibilityPrivate:
+        return true
+    }
+    return false
+}
+
+// Invite is a code that makes whoever accepts it a member of the group.
+type Invite struct {
+    Code      string    `json:"code"`
+    GroupId   int       `json:"group_id"`
+    CreatedBy int       `json:"created_by"`
+    ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewInvite makes and saves an invite to the group on behalf of the user.
+func NewInvite(group *Group, user *User) (*Invite, error) {
+    code := make([]byte, 12)
+    _, err := rand.Read(code)
+    if err != nil {
+        return nil, NewInternalError(ErrCodeInternal, "Error making invite", err)
+    }
+
+    invite := &Invite{
+        Code:      hex.EncodeToString(code),
+        GroupId:   group.Id,
+        CreatedBy: user.Id,
+        ExpiresAt: time.Now().UTC().Add(inviteTTL).Truncate(time.Second),
+    }
+    err = store.SaveInvite(invite, inviteTTL)
+    if err != nil {
+        return nil, err
+    }
+    return invite, nil
+}
+
+// IsMember reports whether u belongs to the group. Owners always do.
+func IsMember(u *User, g *Group) (bool, error) {
+    if u == nil {
+        return false, nil
+    }
+    if owns(u, g.OwnerId) {
+        return true, nil
+    }
+    return store.IsGroupMember(g.Id, u.Id)
+}
+
+// FindGroupMembers returns the members of the group, its owner first.
+func FindGroupMembers(g *Group) ([]User, error) {
+    ids, err := store.FindGroupMembers(g.Id)
+    if err != nil {
+        return nil, err
+    }
+    if g.OwnerId != 0 {
+        ids = append([]int{g.OwnerId}, ids...)
+    }
+
+    members := []User{}
+    for i, id := range ids {
+        if i > 0 && id == g.OwnerId {
+            continue
+        }
+        user, err := store.FindUser(id)
+        if appErr, ok := err.(*AppError); ok && appErr.Code == ErrCodeNotFound {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        members = append(members, *user)
+    }
+    return members, nil
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+    "sort"
+    "sync"
+    "time"
+)
+
+// MemoryStore is a GroupStore that lives entirely in process memory. It is
+// meant for local development and tests, and loses everything on restart.
+type MemoryStore struct {
+    mu           sync.RWMutex
+    lastGroupId  int
+    lastGifId    int
+    lastUserId   int
+    groups       map[int]Group
+    gifs         map[int]Gif
+    gifsForGroup map[int][]int
+    objectRefs   map[string]int
+    deleting     map[string]time.Time // object key to when its mark lapses
+    uploads      map[string]pendingUpload
+    users        map[int]User
+    apiKeys      map[string]ApiKey
+    revoked      map[string]time.Time // token jti to when it expires
+    members      map[int]map[int]bool
+    invites      map[string]Invite
+    votes        map[int]map[int]int // gif id to user id to vote
+}
+
+type pendingUpload struct {
+    PendingUpload
+    expires time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+    return &MemoryStore{
+        groups:       make(map[int]Group),
+        gifs:         make(map[int]Gif),
+        gifsForGroup: make(map[int][]int),
+        objectRefs:   make(map[string]int),
+        deleting:     make(map[string]time.Time),
+        uploads:      make(map[string]pendingUpload),
+        users:        make(map[int]User),
+        apiKeys:      make(map[string]ApiKey),
+        revoked:      make(map[string]time.Time),
+        members:      make(map[int]map[int]bool),
+        invites:      make(map[string]Invite),
+        votes:        make(map[int]map[int]int),
+    }
+}
+
+func (s *MemoryStore) Status() StoreStatus {
+    return StoreStatus{Backend: "memory", Healthy: true}
+}
+
+func (s *MemoryStore) NextGroupId() (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.lastGroupId++
+    return s.lastGroupId, nil
+}
+
+func (s *MemoryStore) NextGifId() (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.lastGifId++
+    return s.lastGifId, nil
+}
+
+func (s *MemoryStore) FindGroup(id int) (*Group, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    group, ok := s.groups[id]
+    if !ok {
+        return nil, NewNotFoundError("Group not found")
+    }
+    return &group, nil
+}
+
+func (s *MemoryStore) FindAllGroups(q ListQuery) (Groups, Page, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    items := make([]ListItem, 0, len(s.groups))
+    for _, group := range s.groups {
+        items = append(items, ListItem{Id: group.Id, Score: groupScore(&group)})
+    }
+
+    items, next := Paginate(items, q)
+    var groups Groups
+    for _, item := range items {
+        groups = append(groups, s.groups[item.Id])
+    }
+    total := len(s.groups)
+    return groups, Page{NextCursor: next, Total: &total}, nil
+}
+
+func (s *MemoryStore) FindGroupGifs(groupId int, q ListQuery) (Gifs, Page, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    ids := s.gifsForGroup[groupId]
+    items := make([]ListItem, 0, len(ids))
+    for _, id := range ids {
+        gif := s.gifs[id]
+        items = append(items, ListItem{Id: id, Score: gifScore(&gif)})
+    }
+
+    items, next := Paginate(items, q)
+    var gifs Gifs
+    for _, item := range items {
+        gifs = append(gifs, s.withVotes(s.gifs[item.Id]))
+    }
+    total := len(ids)
+    return gifs, Page{NextCursor: next, Total: &total}, nil
+}
+
+func (s *MemoryStore) FindGif(id int) (*Gif, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    gif, ok := s.gifs[id]
+    if !ok {
+        return nil, NewNotFoundError("Gif not found")
+    }
+    gif = s.withVotes(gif)
+    return &gif, nil
+}
+
+func (s *MemoryStore) SaveGroup(g *Group) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.groups[g.Id] = *g
+    return nil
+}
+
+func (s *MemoryStore) SaveGif(gif *Gif) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, exists := s.gifs[gif.Id]; !exists {
+        s.gifsForGroup[gif.GroupId] = append(s.gifsForGroup[gif.GroupId], gif.Id)
+    }
+    s.gifs[gif.Id] = *gif
+    return nil
+}
+
+func (s *MemoryStore) MoveGif(gif *Gif, groupId int) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.removeFromGroup(gif.Id, gif.GroupId)
+    gif.GroupId = groupId
+    s.gifsForGroup[groupId] = append(s.gifsForGroup[groupId], gif.Id)
+    s.gifs[gif.Id] = *gif
+    return nil
+}
+
+func (s *MemoryStore) DeleteGroup(id int) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for _, gifId := range s.gifsForGroup[id] {
+        delete(s.gifs, gifId)
+        delete(s.votes, gifId)
+    }
+    delete(s.gifsForGroup, id)
+    delete(s.groups, id)
+    delete(s.members, id)
+    return nil
+}
+
+func (s *MemoryStore) DeleteGif(gif *Gif) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.removeFromGroup(gif.Id, gif.GroupId)
+    delete(s.gifs, gif.Id)
+    delete(s.votes, gif.Id)
+    return nil
+}
+
+func (s *MemoryStore) VoteGif(gif *Gif, userId, vote int) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.gifs[gif.Id]; !ok {
+        return NewNotFoundError("Gif not found")
+    }
+    if s.votes[gif.Id] == nil {
+        s.votes[gif.Id] = make(map[int]int)
+    }
+    if vote == 0 {
+        delete(s.votes[gif.Id], userId)
+    } else {
+        s.votes[gif.Id][userId] = vote
+    }
+    *gif = s.withVotes(*gif)
+    return nil
+}
+
+func (s *MemoryStore) FindGroupLeaderboard(groupId, limit int) (Gifs, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    gifs := Gifs{}
+    for _, id := range s.gifsForGroup[groupId] {
+        gifs = append(gifs, s.withVotes(s.gifs[id]))
+    }
+    sort.SliceStable(gifs, func(i, j int) bool {
+        if GifScore(&gifs[i]) != GifScore(&gifs[j]) {
+            return GifScore(&gifs[i]) > GifScore(&gifs[j])
+        }
+        return gifs[i].Id > gifs[j].Id
+    })
+    if len(gifs) > limit {
+        gifs = gifs[:limit]
+    }
+    return gifs, nil
+}
+
+func (s *MemoryStore) RetainObject(key string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.objectRefs[key]++
+    return nil
+}
+
+func (s *MemoryStore) ReleaseObject(key string) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    refs := s.objectRefs[key] - 1
+    if refs <= 0 {
+        delete(s.objectRefs, key)
+        s.deleting[key] = time.Now().Add(objectDeletingTTL)
+        return 0, nil
+    }
+    s.objectRefs[key] = refs
+    return refs, nil
+}
+
+func (s *MemoryStore) ObjectDeleting(key string) (bool, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    expires, ok := s.deleting[key]
+    return ok && time.Now().Before(expires), nil
+}
+
+func (s *MemoryStore) ObjectDeleted(key string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    delete(s.deleting, key)
+    return nil
+}
+
+func (s *MemoryStore) NextUserId() (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.lastUserId++
+    return s.lastUserId, nil
+}
+
+func (s *MemoryStore) FindUser(id int) (*User, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    user, ok := s.users[id]
+    if !ok {
+        return nil, NewNotFoundError("User not found")
+    }
+    return &user, nil
+}
+
+func (s *MemoryStore) SaveUser(u *User) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.users[u.Id] = *u
+    return nil
+}
+
+func (s *MemoryStore) FindApiKey(id string) (*ApiKey, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    key, ok := s.apiKeys[id]
+    if !ok {
+        return nil, NewNotFoundError("API key not found")
+    }
+    return &key, nil
+}
+
+func (s *MemoryStore) SaveApiKey(k *ApiKey) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.apiKeys[k.Id] = *k
+    return nil
+}
+
+func (s *MemoryStore) DeleteApiKey(id string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    delete(s.apiKeys, id)
+    return nil
+}
+
+func (s *MemoryStore) AddGroupMember(groupId, userId int) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.members[groupId] == nil {
+        s.members[groupId] = make(map[int]bool)
+    }
+    s.members[groupId][userId] = true
+    return nil
+}
+
+func (s *MemoryStore) RemoveGroupMember(groupId, userId int) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    delete(s.members[groupId], userId)
+    return nil
+}
+
+func (s *MemoryStore) IsGroupMember(groupId, userId int) (bool, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    return s.members[groupId][userId], nil
+}
+
+func (s *MemoryStore) FindGroupMembers(groupId int) ([]int, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    ids := []int{}
+    for id := range s.members[groupId] {
+        ids = append(ids, id)
+    }
+    sort.Ints(ids)
+    return ids, nil
+}
+
+// SaveInvite keeps the invite until its ExpiresAt, which NewInvite sets from
+// the same ttl.
+func (s *MemoryStore) SaveInvite(inv *Invite, ttl time.Duration) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.invites[inv.Code] = *inv
+    return nil
+}
+
+func (s *MemoryStore) FindInvite(code string) (*Invite, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    inv, ok := s.invites[code]
+    if !ok || time.Now().After(inv.ExpiresAt) {
+        return nil, NewNotFoundError("Invite not found")
+    }
+    return &inv, nil
+}
+
+func (s *MemoryStore) DeleteInvite(code string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    delete(s.invites, code)
+    return nil
+}
+
+func (s *MemoryStore) RevokeToken(jti string, ttl time.Duration) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    now := time.Now()
+    for id, expires := range s.revoked {
+        if now.After(expires) {
+            delete(s.revoked, id)
+        }
+    }
+    if _, ok := s.revoked[jti]; ok {
+        return false, nil
+    }
+    s.revoked[jti] = now.Add(ttl)
+    return true, nil
+}
+
+func (s *MemoryStore) IsTokenRevoked(jti string) (bool, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    expires, ok := s.revoked[jti]
+    return ok && time.Now().Before(expires), nil
+}
+
+func (s *MemoryStore) SavePendingUpload(u *PendingUpload, ttl time.Duration) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.uploads[u.Id] = pendingUpload{PendingUpload: *u, expires: time.Now().Add(ttl)}
+    return nil
+}
+
+func (s *MemoryStore) FindPendingUpload(id string) (*PendingUpload, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    u, ok := s.uploads[id]
+    if !ok || time.Now().After(u.expires) {
+        return nil, NewNotFoundError("Upload not found")
+    }
+    return &u.PendingUpload, nil
+}
+
+func (s *MemoryStore) DeletePendingUpload(id string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    u, ok := s.uploads[id]
+    delete(s.uploads, id)
+    return ok && time.Now().Before(u.expires), nil
+}
+
+// withVotes returns gif with its vote counts filled in. The caller must hold
+// the lock.
+func (s *MemoryStore) withVotes(gif Gif) Gif {
+    gif.Upvotes, gif.Downvotes = 0, 0
+    for _, vote := range s.votes[gif.Id] {
+        if vote > 0 {
+            gif.Upvotes++
+        } else {
+            gif.Downvotes++
+        }
+    }
+    return gif
+}
+
+// removeFromGroup drops gifId from the group's gif list. The caller must hold
+// the write lock.
+func (s *MemoryStore) removeFromGroup(gifId, groupId int) {
+    ids := s.gifsForGroup[groupId]
+    for i, id := range ids {
+        if id == gifId {
+            s.gifsForGroup[groupId] = append(ids[:i:i], ids[i+1:]...)
+            return
+        }
+    }
+}
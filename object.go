@@ -0,0 +1,84 @@
+package main
+
+import "time"
+
+// objectDeletingTTL bounds how long an object stays marked as deleting, should
+// the release that marked it never get to clear the mark.
+const objectDeletingTTL = time.Minute
+
+// ObjectKey returns the blob path of the image whose content hashes to sum.
+// Keys depend only on content, so identical uploads share one object and
+// client filenames never reach the store.
+func ObjectKey(sum string) string {
+    return "objects/" + sum + ".gif"
+}
+
+// ObjectPaths returns the paths of the object stored under key and of its
+// renditions.
+func ObjectPaths(key string) []string {
+    return []string{key, PosterPath(key), PreviewPath(key)}
+}
+
+// ObjectUrls returns the image, poster and preview URLs of the object stored
+// under key.
+func ObjectUrls(key string) (string, string, string) {
+    return blobs.URL(key), blobs.URL(PosterPath(key)), blobs.URL(PreviewPath(key))
+}
+
+// SaveObject stores the upload and its renditions under their
+// content-addressed key, unless an identical upload already has, and takes a
+// reference to the object on behalf of the caller's record.
+func SaveObject(u *Upload) (string, error) {
+    key := ObjectKey(u.Sha256)
+
+    // Retain before checking, so a later release can't delete the object
+    // between the check and the record being saved.
+    err := store.RetainObject(key)
+    if err != nil {
+        return "", err
+    }
+
+    // A release that dropped the last reference beforehand may still be
+    // deleting the blobs, so wait for it to finish before checking them.
+    deleting, err := store.ObjectDeleting(key)
+    for err == nil && deleting {
+        time.Sleep(100 * time.Millisecond)
+        deleting, err = store.ObjectDeleting(key)
+    }
+
+    // The preview is written last, so an object whose earlier upload failed
+    // part way is stored again.
+    var exists bool
+    if err == nil {
+        exists, err = blobs.Exists(PreviewPath(key))
+    }
+    if err == nil && !exists {
+        err = u.store(key)
+        if err == nil {
+            err = SaveRenditions(key, u.Decoded)
+        }
+    }
+    if err != nil {
+        // Releasing through ReleaseObject deletes whatever was stored and
+        // clears the deleting mark, so the upload can be retried at once.
+        ReleaseObject(key)
+        return "", err
+    }
+    return key, nil
+}
+
+// ReleaseObject drops a reference to the object stored under key, deleting
+// it and its renditions once no record uses them.
+func ReleaseObject(key string) error {
+    refs, err := store.ReleaseObject(key)
+    if err != nil || refs > 0 {
+        return err
+    }
+
+    err = DeleteBlobs(ObjectPaths(key))
+    if err != nil {
+        store.ObjectDeleted(key)
+        return err
+    }
+    return store.ObjectDeleted(key)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+    "errors"
+    "image/color"
+    "strings"
+    "testing"
+    "time"
+)
+
+// TestSaveObjectWhileDeleting saves an object while the release of its last
+// reference is still deleting the blobs, and checks that it is stored again
+// once they are gone rather than being taken to exist already.
+func TestSaveObjectWhileDeleting(t *testing.T) {
+    testServer(t, NewMemoryStore())
+
+    content := testGif(t, color.White)
+    upload, err := NewUpload(content, "test.gif")
+    if err != nil {
+        t.Fatal(err)
+    }
+    key, err := SaveObject(upload)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Drop the last reference as ReleaseObject does, leaving the blobs to
+    // be deleted.
+    refs, err := store.ReleaseObject(key)
+    if err != nil || refs != 0 {
+        t.Fatalf("got %v references, error %v", refs, err)
+    }
+
+    saved := make(chan error)
+    go func() {
+        upload, err := NewUpload(content, "test.gif")
+        if err == nil {
+            _, err = SaveObject(upload)
+        }
+        saved <- err
+    }()
+
+    select {
+    case err := <-saved:
+        t.Fatalf("saved while the object was being deleted, error %v", err)
+    case <-time.After(300 * time.Millisecond):
+    }
+
+    err = DeleteBlobs(ObjectPaths(key))
+    if err == nil {
+        err = store.ObjectDeleted(key)
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := <-saved; err != nil {
+        t.Fatal(err)
+    }
+
+    for _, path := range ObjectPaths(key) {
+        exists, err := blobs.Exists(path)
+        if err != nil || !exists {
+            t.Errorf("%v exists %v, error %v", path, exists, err)
+        }
+    }
+}
+
+// failPosters fails to store posters once after posters have been stored,
+// leaving the image of an object that is being saved behind without its
+// renditions.
+type failPosters struct {
+    BlobStore
+    after int
+}
+
+func (b *failPosters) Put(path string, data []byte, contentType string) error {
+    if strings.HasSuffix(path, ".poster.png") {
+        if b.after == 0 {
+            return errors.New("blob store unavailable")
+        }
+        b.after--
+    }
+    return b.BlobStore.Put(path, data, contentType)
+}
+
+// retryFailedSave saves an object whose renditions fail to store, and checks
+// that saving it again succeeds straight away rather than waiting for the
+// deleting mark of the failed save to expire.
+func retryFailedSave(t *testing.T, s GroupStore) {
+    testServer(t, s)
+    working := blobs
+
+    content := testGif(t, color.White)
+    upload, err := NewUpload(content, "test.gif")
+    if err != nil {
+        t.Fatal(err)
+    }
+    blobs = &failPosters{BlobStore: working}
+    if _, err := SaveObject(upload); err == nil {
+        t.Fatal("saved an object whose poster failed to store")
+    }
+    blobs = working
+
+    key := ObjectKey(upload.Sha256)
+    deleting, err := store.ObjectDeleting(key)
+    if err != nil || deleting {
+        t.Errorf("object deleting %v after the failed save, error %v", deleting, err)
+    }
+
+    saved := make(chan error)
+    go func() {
+        _, err := SaveObject(upload)
+        saved <- err
+    }()
+    select {
+    case err := <-saved:
+        if err != nil {
+            t.Fatal(err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("saving again waited on the failed save")
+    }
+
+    for _, path := range ObjectPaths(key) {
+        exists, err := blobs.Exists(path)
+        if err != nil || !exists {
+            t.Errorf("%v exists %v, error %v", path, exists, err)
+        }
+    }
+}
+
+func TestRetryFailedSaveMemory(t *testing.T) {
+    retryFailedSave(t, NewMemoryStore())
+}
+
+func TestRetryFailedSaveRedis(t *testing.T) {
+    retryFailedSave(t, testRedisStore(t))
+}
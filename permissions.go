@@ -0,0 +1,275 @@
+package main
+
+import (
+    "net/http"
+
+    "github.com/labstack/echo"
+)
+
+const (
+    RolePlayer    = "player"
+    RoleModerator = "moderator"
+    RoleAdmin     = "admin"
+)
+
+// ValidRole reports whether role is one of the roles a user can be given.
+func ValidRole(role string) bool {
+    switch role {
+    case RolePlayer, RoleModerator, RoleAdmin:
+        return true
+    }
+    return false
+}
+
+// The permission checks below take the user making the request, which is nil
+// for anonymous requests. Users registered before roles were introduced have
+// no role, and are treated as players.
+
+func isAdmin(u *User) bool {
+    return u != nil && u.Role == RoleAdmin
+}
+
+// isModerator reports whether u can moderate content. Admins can do anything
+// moderators can.
+func isModerator(u *User) bool {
+    return u != nil && (u.Role == RoleModerator || u.Role == RoleAdmin)
+}
+
+// owns reports whether u created the record owned by ownerId. Records created
+// before users were introduced are owned by no one.
+func owns(u *User, ownerId int) bool {
+    return u != nil && ownerId != 0 && u.Id == ownerId
+}
+
+func forbiddenError(message string) error {
+    return NewAppError(http.StatusForbidden, ErrCodeForbidden, message, nil)
+}
+
+// CanSeeGroup reports whether u can see the group. Private groups are only
+// visible to their members and moderators, and hidden groups to their owner
+// and moderators.
+func CanSeeGroup(u *User, g *Group) (bool, error) {
+    if isModerator(u) {
+        return true, nil
+    }
+    if g.Hidden && !owns(u, g.OwnerId) {
+        return false, nil
+    }
+    if g.Visibility == VisibilityPrivate {
+        return IsMember(u, g)
+    }
+    return true, nil
+}
+
+// CanListGroup reports whether the group is included when u lists groups.
+// Unlisted groups are left out for all but their owner and moderators.
+func CanListGroup(u *User, g *Group) (bool, error) {
+    if g.Visibility == VisibilityUnlisted && !owns(u, g.OwnerId) && !isModerator(u) {
+        return false, nil
+    }
+    return CanSeeGroup(u, g)
+}
+
+// CanSeeGif reports whether u, who can see group, can see the gif in it.
+func CanSeeGif(u *User, gif *Gif, group *Group) bool {
+    return !gif.Hidden || owns(u, gif.OwnerId) || owns(u, group.OwnerId) || isModerator(u)
+}
+
+// CheckAddGif allows anyone to add gifs to public and unlisted groups, but
+// only members and admins to add them to private ones. Only moderators and
+// admins can add gifs to a hidden group.
+func CheckAddGif(u *User, g *Group) error {
+    if g.Hidden && !isModerator(u) {
+        return forbiddenError("Gifs can't be added to a hidden group")
+    }
+    if g.Visibility != VisibilityPrivate || isAdmin(u) {
+        return nil
+    }
+
+    member, err := IsMember(u, g)
+    if err != nil || member {
+        return err
+    }
+    return forbiddenError("Only members can add gifs to a private group")
+}
+
+// CheckEditGroup allows the group's owner and admins to rename, replace the
+// image of, change the visibility of or delete the group, and to manage its
+// members and invites.
+func CheckEditGroup(u *User, g *Group) error {
+    if owns(u, g.OwnerId) || isAdmin(u) {
+        return nil
+    }
+    return forbiddenError("Only the group's owner or an admin can change it")
+}
+
+// CheckRemoveGif allows the gif's uploader, the owner of its group and admins
+// to delete the gif or move it out of the group.
+func CheckRemoveGif(u *User, gif *Gif, group *Group) error {
+    if owns(u, gif.OwnerId) || owns(u, group.OwnerId) || isAdmin(u) {
+        return nil
+    }
+    return forbiddenError("Only the gif's uploader, the group's owner or an admin can remove it")
+}
+
+// CheckListMembers allows the group's members, including its owner, and
+// moderators to list its members.
+func CheckListMembers(u *User, g *Group) error {
+    if isModerator(u) {
+        return nil
+    }
+    member, err := IsMember(u, g)
+    if err != nil || member {
+        return err
+    }
+    return forbiddenError("Only the group's members, moderators and admins can list its members")
+}
+
+// CheckModerate allows moderators and admins to hide and unhide content.
+func CheckModerate(u *User) error {
+    if isModerator(u) {
+        return nil
+    }
+    return forbiddenError("Only moderators and admins can do this")
+}
+
+// CheckAdmin allows admins alone, e.g. to change users' roles.
+func CheckAdmin(u *User) error {
+    if isAdmin(u) {
+        return nil
+    }
+    return forbiddenError("Only admins can do this")
+}
+
+// ListedGroups leaves out the groups u can't list.
+func ListedGroups(u *User, groups Groups) (Groups, error) {
+    listed := Groups{}
+    for _, group := range groups {
+        ok, err := CanListGroup(u, &group)
+        if err != nil {
+            return nil, err
+        }
+        if ok {
+            listed = append(listed, group)
+        }
+    }
+    return listed, nil
+}
+
+// VisibleGifs leaves out the gifs of group, which u can see, that u can't.
+func VisibleGifs(u *User, gifs Gifs, group *Group) Gifs {
+    visible := Gifs{}
+    for _, gif := range gifs {
+        if CanSeeGif(u, &gif, group) {
+            visible = append(visible, gif)
+        }
+    }
+    return visible
+}
+
+// FindVisibleGifs returns a page of the gifs in group that u can see. The
+// store pages through every gif in the group, so its pages are read until
+// enough gifs are found or none are left; only the last page comes back
+// short. The total is only reported to the group's owner and moderators, who
+// can see every gif in it.
+func FindVisibleGifs(u *User, group *Group, q ListQuery) (Gifs, Page, error) {
+    visible := Gifs{}
+    storeQuery := q
+    for {
+        gifs, page, err := store.FindGroupGifs(group.Id, storeQuery)
+        if err != nil {
+            return nil, Page{}, err
+        }
+        if !owns(u, group.OwnerId) && !isModerator(u) {
+            page.Total = nil
+        }
+
+        for i, gif := range gifs {
+            if CanSeeGif(u, &gif, group) {
+                visible = append(visible, gif)
+            }
+            if len(visible) == q.Limit {
+                if i < len(gifs)-1 || len(page.NextCursor) > 0 {
+                    page.NextCursor = q.Cursor(ListItem{Id: gif.Id, Score: gifScore(&gif)})
+                }
+                return visible, page, nil
+            }
+        }
+
+        if len(page.NextCursor) == 0 {
+            return visible, page, nil
+        }
+        err = storeQuery.ParseCursor(page.NextCursor)
+        if err != nil {
+            return nil, Page{}, NewInternalError(ErrCodeInternal, "Error listing gifs", err)
+        }
+    }
+}
+
+// FindVisibleLeaders returns the limit highest scoring gifs in group that u
+// can see. Scores change as votes come in, so rather than paging through the
+// leaderboard it is read again from the top, twice as far each time, until
+// enough gifs are found or none are left.
+func FindVisibleLeaders(u *User, group *Group, limit int) (Gifs, error) {
+    for n := limit; ; n *= 2 {
+        gifs, err := store.FindGroupLeaderboard(group.Id, n)
+        if err != nil {
+            return nil, err
+        }
+
+        visible := VisibleGifs(u, gifs, group)
+        if len(visible) >= limit {
+            return visible[:limit], nil
+        }
+        if len(gifs) < n {
+            return visible, nil
+        }
+    }
+}
+
+// FindListedGroups returns a page of the groups u can list, reading the
+// store's pages as FindVisibleGifs does. The total is only reported to
+// moderators, who can list every group.
+func FindListedGroups(u *User, q ListQuery) (Groups, Page, error) {
+    listed := Groups{}
+    storeQuery := q
+    for {
+        groups, page, err := store.FindAllGroups(storeQuery)
+        if err != nil {
+            return nil, Page{}, err
+        }
+        if !isModerator(u) {
+            page.Total = nil
+        }
+
+        for i, group := range groups {
+            ok, err := CanListGroup(u, &group)
+            if err != nil {
+                return nil, Page{}, err
+            }
+            if ok {
+                listed = append(listed, group)
+            }
+            if len(listed) == q.Limit {
+                if i < len(groups)-1 || len(page.NextCursor) > 0 {
+                    page.NextCursor = q.Cursor(ListItem{Id: group.Id, Score: groupScore(&group)})
+                }
+                return listed, page, nil
+            }
+        }
+
+        if len(page.NextCursor) == 0 {
+            return listed, page, nil
+        }
+        err = storeQuery.ParseCursor(page.NextCursor)
+        if err != nil {
+            return nil, Page{}, NewInternalError(ErrCodeInternal, "Error listing groups", err)
+        }
+    }
+}
+
+// RequestUser returns the user making the request, or nil if it is anonymous.
+func RequestUser(c *echo.Context) *User {
+    user, _ := c.Get(userContextKey).(*User)
+    return user
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+    "fmt"
+    "image/color"
+    "net/http"
+    "testing"
+    "time"
+)
+
+// fillPages lists groups and gifs two to a page, where the store holds a
+// group or gif the user can't see between each one they can, and checks that
+// every page but the last is full and the total is only given to those who
+// see the whole list.
+func fillPages(t *testing.T, s GroupStore) {
+    testServer(t, s)
+
+    owner := &User{Id: 1000, Role: RolePlayer}
+    moderator := &User{Id: 1001, Role: RoleModerator}
+    now := time.Now().UTC()
+
+    for i := 1; i <= 8; i++ {
+        group := &Group{Id: i, Name: "group", OwnerId: owner.Id, Visibility: VisibilityPublic, CreatedAt: now}
+        if i%2 == 0 {
+            group.Visibility = VisibilityUnlisted
+        }
+        if err := store.SaveGroup(group); err != nil {
+            t.Fatal(err)
+        }
+    }
+    group := &Group{Id: 1, OwnerId: owner.Id, Visibility: VisibilityPublic}
+    for i := 1; i <= 8; i++ {
+        gif := &Gif{Id: i, GroupId: group.Id, OwnerId: owner.Id, Hidden: i%2 == 0, CreatedAt: now}
+        if err := store.SaveGif(gif); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    q := ListQuery{Limit: 2, Sort: SortById}
+    var sizes []int
+    listed := 0
+    for {
+        groups, page, err := FindListedGroups(nil, q)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if page.Total != nil {
+            t.Errorf("groups total %v given to an anonymous user", *page.Total)
+        }
+        sizes = append(sizes, len(groups))
+        listed += len(groups)
+        if len(page.NextCursor) == 0 {
+            break
+        }
+        if err := q.ParseCursor(page.NextCursor); err != nil {
+            t.Fatal(err)
+        }
+    }
+    for i, size := range sizes[:len(sizes)-1] {
+        if size != 2 {
+            t.Errorf("page %v of %v holds %v groups, want 2", i+1, len(sizes), size)
+        }
+    }
+    if listed != 4 {
+        t.Errorf("listed %v groups, want 4", listed)
+    }
+
+    q = ListQuery{Limit: 2, Sort: SortById}
+    gifs, page, err := FindVisibleGifs(nil, group, q)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(gifs) != 2 || gifs[0].Id != 1 || gifs[1].Id != 3 || page.Total != nil || len(page.NextCursor) == 0 {
+        t.Errorf("got %v gifs, total %v and cursor %q, want gifs 1 and 3, no total and a cursor", len(gifs), page.Total, page.NextCursor)
+    }
+
+    _, page, err = FindListedGroups(moderator, ListQuery{Limit: 2, Sort: SortById})
+    if err != nil || page.Total == nil || *page.Total != 8 {
+        t.Errorf("moderator got groups total %v, error %v, want 8", page.Total, err)
+    }
+    _, page, err = FindVisibleGifs(owner, group, ListQuery{Limit: 2, Sort: SortById})
+    if err != nil || page.Total == nil || *page.Total != 8 {
+        t.Errorf("owner got gifs total %v, error %v, want 8", page.Total, err)
+    }
+}
+
+func TestFillPagesMemory(t *testing.T) {
+    fillPages(t, NewMemoryStore())
+}
+
+func TestFillPagesRedis(t *testing.T) {
+    fillPages(t, testRedisStore(t))
+}
+
+// listMembers checks who can list the members of a public group.
+func listMembers(t *testing.T, s GroupStore) {
+    e, outsiderKey := testServer(t, s)
+    owner, ownerKey := testUser(t, RolePlayer)
+    member, memberKey := testUser(t, RolePlayer)
+    _, moderatorKey := testUser(t, RoleModerator)
+
+    group := &Group{Id: 1, Name: "group", OwnerId: owner.Id, Visibility: VisibilityPublic, CreatedAt: time.Now().UTC()}
+    err := store.SaveGroup(group)
+    if err == nil {
+        err = store.AddGroupMember(group.Id, member.Id)
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name   string
+        apiKey string
+        code   int
+    }{
+        {"anonymous", "", http.StatusUnauthorized},
+        {"outsider", outsiderKey, http.StatusForbidden},
+        {"member", memberKey, http.StatusOK},
+        {"owner", ownerKey, http.StatusOK},
+        {"moderator", moderatorKey, http.StatusOK},
+    }
+    for _, test := range tests {
+        var members []User
+        if code := getJSON(t, e, test.apiKey, "/api/v1/groups/1/members", &members); code != test.code {
+            t.Errorf("%v got %v, want %v", test.name, code, test.code)
+        }
+        if test.code == http.StatusOK && len(members) != 2 {
+            t.Errorf("%v got %v members, want 2", test.name, len(members))
+        }
+    }
+}
+
+func TestListMembersMemory(t *testing.T) {
+    listMembers(t, NewMemoryStore())
+}
+
+func TestListMembersRedis(t *testing.T) {
+    listMembers(t, testRedisStore(t))
+}
+
+// permissionMatrix checks what each kind of user can do to a public group and
+// the gifs in it: edit the group, hide a gif, see a hidden gif, delete a gif
+// and change a user's role. Anonymous requests to change anything are refused
+// before any permission is checked.
+func permissionMatrix(t *testing.T, s GroupStore) {
+    e, outsiderKey := testServer(t, s)
+    _, uploaderKey := testUser(t, RolePlayer)
+    _, ownerKey := testUser(t, RolePlayer)
+    _, moderatorKey := testUser(t, RoleModerator)
+    _, adminKey := testUser(t, RoleAdmin)
+    player, _ := testUser(t, RolePlayer)
+
+    groupId, err := postForm(e, ownerKey, "/api/v1/groups", map[string]string{"name": "group"}, testGif(t, color.White))
+    if err != nil {
+        t.Fatal(err)
+    }
+    gifs := fmt.Sprintf("/api/v1/groups/%v/gifs", groupId)
+    hiddenId, err := postForm(e, uploaderKey, gifs, nil, testGif(t, color.Black))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if code := sendForm(t, e, "POST", adminKey, fmt.Sprintf("/api/v1/gifs/%v/hide", hiddenId), nil, nil, nil); code != http.StatusOK {
+        t.Fatalf("hiding got %v", code)
+    }
+
+    const ok, unauthorized, forbidden, notFound = http.StatusOK, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound
+    tests := []struct {
+        name                                string
+        apiKey                              string
+        edit, hide, seeHidden, remove, role int
+    }{
+        {"anonymous", "", unauthorized, unauthorized, notFound, unauthorized, unauthorized},
+        {"outsider", outsiderKey, forbidden, forbidden, notFound, forbidden, forbidden},
+        {"uploader", uploaderKey, forbidden, forbidden, ok, ok, forbidden},
+        {"owner", ownerKey, ok, forbidden, ok, ok, forbidden},
+        {"moderator", moderatorKey, forbidden, ok, ok, forbidden, forbidden},
+        {"admin", adminKey, ok, ok, ok, ok, ok},
+    }
+    for i, test := range tests {
+        gifId, err := postForm(e, uploaderKey, gifs, nil, testGif(t, color.Gray{uint8(i * 40)}))
+        if err != nil {
+            t.Fatal(err)
+        }
+        gif := fmt.Sprintf("/api/v1/gifs/%v", gifId)
+
+        codes := []int{
+            sendForm(t, e, "PATCH", test.apiKey, fmt.Sprintf("/api/v1/groups/%v", groupId), map[string]string{"name": test.name}, nil, nil),
+            sendForm(t, e, "POST", test.apiKey, gif+"/hide", nil, nil, nil),
+            getJSON(t, e, test.apiKey, fmt.Sprintf("/api/v1/gifs/%v", hiddenId), nil),
+            sendForm(t, e, "DELETE", test.apiKey, gif, nil, nil, nil),
+            sendForm(t, e, "PUT", test.apiKey, fmt.Sprintf("/api/v1/users/%v/role", player.Id), map[string]string{"role": RoleAdmin}, nil, nil),
+        }
+        want := []int{test.edit, test.hide, test.seeHidden, test.remove, test.role}
+        for j, action := range []string{"editing the group", "hiding a gif", "seeing a hidden gif", "deleting a gif", "changing a role"} {
+            if codes[j] != want[j] {
+                t.Errorf("%v %v got %v, want %v", test.name, action, codes[j], want[j])
+            }
+        }
+    }
+}
+
+func TestPermissionMatrixMemory(t *testing.T) {
+    permissionMatrix(t, NewMemoryStore())
+}
+
+func TestPermissionMatrixRedis(t *testing.T) {
+    permissionMatrix(t, testRedisStore(t))
+}
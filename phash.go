@@ -0,0 +1,204 @@
+package main
+
+import (
+    "fmt"
+    "image"
+    "image/gif"
+    "math/bits"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+const (
+    DuplicateReject = "reject"
+    DuplicateWarn   = "warn"
+    DuplicateAllow  = "allow"
+
+    // phashFrames is how many frames, spread evenly through the animation,
+    // are hashed for each gif.
+    phashFrames = 4
+)
+
+// DuplicatePolicy decides what POST /groups/:id/gifs does with an upload
+// that looks like a gif already in the group: within Threshold bits of it,
+// on average across the sampled frames.
+type DuplicatePolicy struct {
+    Action    string // DuplicateReject, DuplicateWarn or DuplicateAllow
+    Threshold int
+}
+
+var duplicatePolicy = DuplicatePolicy{Action: DuplicateWarn, Threshold: 10}
+
+// PerceptualHash returns the dHash of phashFrames frames sampled from the
+// composed animation, as hex strings. Re-encoding, resizing or recolouring
+// a gif only changes a few bits of each.
+func PerceptualHash(decoded *gif.GIF) []string {
+    hashes := make([]string, phashFrames)
+    composeFrames(decoded, func(i int, canvas *image.RGBA) error {
+        for sample := range hashes {
+            if sample*len(decoded.Image)/phashFrames == i {
+                hashes[sample] = fmt.Sprintf("%016x", dHash(canvas))
+            }
+        }
+        return nil
+    })
+    return hashes
+}
+
+// dHash shrinks img to 9x8 grey cells and sets one bit per pair of
+// horizontally adjacent cells, for whether the left one is brighter.
+func dHash(img *image.RGBA) uint64 {
+    var cells [8][9]uint64
+    var counts [8][9]uint64
+
+    bounds := img.Bounds()
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        row := (y - bounds.Min.Y) * 8 / bounds.Dy()
+        for x := bounds.Min.X; x < bounds.Max.X; x++ {
+            col := (x - bounds.Min.X) * 9 / bounds.Dx()
+            pix := img.Pix[img.PixOffset(x, y):]
+            cells[row][col] += (299*uint64(pix[0]) + 587*uint64(pix[1]) + 114*uint64(pix[2])) / 1000
+            counts[row][col]++
+        }
+    }
+
+    var hash uint64
+    for row := 0; row < 8; row++ {
+        for col := 0; col < 8; col++ {
+            hash <<= 1
+            left := cells[row][col] / atLeastOneCount(counts[row][col])
+            right := cells[row][col+1] / atLeastOneCount(counts[row][col+1])
+            if left > right {
+                hash |= 1
+            }
+        }
+    }
+    return hash
+}
+
+// atLeastOneCount guards against empty cells in images narrower than 9 or
+// shorter than 8 pixels.
+func atLeastOneCount(n uint64) uint64 {
+    if n == 0 {
+        return 1
+    }
+    return n
+}
+
+// HashDistance returns the average number of bits that differ between the
+// perceptual hashes of two gifs, and false if either has none to compare,
+// e.g. because it was uploaded before hashes were recorded.
+func HashDistance(a, b []string) (int, bool) {
+    if len(a) == 0 || len(a) != len(b) {
+        return 0, false
+    }
+
+    total := 0
+    for i := range a {
+        x, errX := strconv.ParseUint(a[i], 16, 64)
+        y, errY := strconv.ParseUint(b[i], 16, 64)
+        if errX != nil || errY != nil {
+            return 0, false
+        }
+        total += bits.OnesCount64(x ^ y)
+    }
+    return total / len(a), true
+}
+
+// LooksAlike reports whether two gifs are within duplicatePolicy.Threshold of
+// each other. Their aspect ratios must match to within a tenth as well, since
+// the hashes of images with little detail are close whatever their shape.
+func LooksAlike(a, b *Gif) bool {
+    distance, ok := HashDistance(a.PHash, b.PHash)
+    if !ok || distance > duplicatePolicy.Threshold {
+        return false
+    }
+
+    wide, narrow := a.Width*b.Height, b.Width*a.Height
+    if wide < narrow {
+        wide, narrow = narrow, wide
+    }
+    return wide*10 <= narrow*11
+}
+
+// FindDuplicates returns the gifs in candidates that look like g.
+func FindDuplicates(g *Gif, candidates Gifs) Gifs {
+    duplicates := Gifs{}
+    for _, candidate := range candidates {
+        if candidate.Id == g.Id {
+            continue
+        }
+        if LooksAlike(g, &candidate) {
+            duplicates = append(duplicates, candidate)
+        }
+    }
+    return duplicates
+}
+
+// CheckDuplicates applies duplicatePolicy to g, which is about to be added to
+// its group, whose gifs are candidates. It returns a conflict AppError if the
+// policy rejects g, and any warnings for the client otherwise.
+func CheckDuplicates(g *Gif, candidates Gifs) ([]string, error) {
+    if duplicatePolicy.Action == DuplicateAllow {
+        return nil, nil
+    }
+
+    duplicates := FindDuplicates(g, candidates)
+    if len(duplicates) == 0 {
+        return nil, nil
+    }
+
+    ids := make([]string, len(duplicates))
+    for i, duplicate := range duplicates {
+        ids[i] = strconv.Itoa(duplicate.Id)
+    }
+    message := fmt.Sprintf("Gif looks like a duplicate of gif %v in this group", strings.Join(ids, ", "))
+
+    if duplicatePolicy.Action == DuplicateReject {
+        return nil, NewAppError(http.StatusConflict, ErrCodeDuplicate, message, nil)
+    }
+    return []string{message}, nil
+}
+
+// ClusterDuplicates groups gifs that look alike, directly or through a chain
+// of lookalikes. Gifs that look like no other are left out.
+func ClusterDuplicates(gifs Gifs) []Gifs {
+    parent := make([]int, len(gifs))
+    for i := range parent {
+        parent[i] = i
+    }
+    root := func(i int) int {
+        for parent[i] != i {
+            parent[i] = parent[parent[i]]
+            i = parent[i]
+        }
+        return i
+    }
+
+    for i := range gifs {
+        for j := i + 1; j < len(gifs); j++ {
+            if LooksAlike(&gifs[i], &gifs[j]) {
+                parent[root(j)] = root(i)
+            }
+        }
+    }
+
+    members := make(map[int]Gifs)
+    order := []int{}
+    for i, gif := range gifs {
+        r := root(i)
+        if _, seen := members[r]; !seen {
+            order = append(order, r)
+        }
+        members[r] = append(members[r], gif)
+    }
+
+    clusters := []Gifs{}
+    for _, r := range order {
+        if len(members[r]) > 1 {
+            clusters = append(clusters, members[r])
+        }
+    }
+    return clusters
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "image/color"
+    "net/http"
+    "strconv"
+    "testing"
+)
+
+// duplicateUploads uploads gifs that look alike under each duplicate policy,
+// and checks that moderators are shown them as duplicates.
+func duplicateUploads(t *testing.T, s GroupStore) {
+    e, apiKey := testServer(t, s)
+    _, moderatorKey := testUser(t, RoleModerator)
+    previous := duplicatePolicy
+    t.Cleanup(func() { duplicatePolicy = previous })
+
+    groupId, err := postForm(e, apiKey, "/api/v1/groups", map[string]string{"name": "group"}, testGif(t, color.White))
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := "/api/v1/groups/" + strconv.Itoa(groupId) + "/gifs"
+
+    // Images of one flat colour look alike whatever the colour.
+    tests := []struct {
+        action string
+        color  color.Color
+        code   int
+    }{
+        {DuplicateReject, color.RGBA{255, 0, 0, 255}, http.StatusOK},
+        {DuplicateReject, color.RGBA{0, 255, 0, 255}, http.StatusConflict},
+        {DuplicateWarn, color.RGBA{0, 255, 0, 255}, http.StatusOK},
+        {DuplicateAllow, color.RGBA{0, 0, 255, 255}, http.StatusOK},
+    }
+    for _, test := range tests {
+        duplicatePolicy.Action = test.action
+        if code := sendForm(t, e, "POST", apiKey, path, nil, testGif(t, test.color), nil); code != test.code {
+            t.Errorf("%v policy got %v for a lookalike, want %v", test.action, code, test.code)
+        }
+    }
+
+    if code := getJSON(t, e, apiKey, "/api/v1/gifs/duplicates", nil); code != http.StatusForbidden {
+        t.Errorf("player listing duplicates got %v, want %v", code, http.StatusForbidden)
+    }
+    var clusters []Gifs
+    if code := getJSON(t, e, moderatorKey, "/api/v1/gifs/duplicates", &clusters); code != http.StatusOK || len(clusters) != 1 || len(clusters[0]) != 3 {
+        t.Errorf("moderator got %v and clusters %v, want one of 3 gifs", code, clusters)
+    }
+}
+
+func TestDuplicateUploadsMemory(t *testing.T) {
+    duplicateUploads(t, NewMemoryStore())
+}
+
+func TestDuplicateUploadsRedis(t *testing.T) {
+    duplicateUploads(t, testRedisStore(t))
+}
@@ -0,0 +1,1060 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/garyburd/redigo/redis"
+)
+
+// ErrStoreUnavailable is returned when the store cannot be reached at all,
+// e.g. Redis is down or the connection pool is exhausted.
+var ErrStoreUnavailable = errors.New("store unavailable")
+
+// deleteGroupScript removes a group, its gifsForGroup and gifIdsForGroup
+// sets, every gif in them with its votes, and its membersForGroup set and
+// leaderboard in one step, so no gif can be left behind without a group.
+var deleteGroupScript = redis.NewScript(7, `
+local gifs = redis.call('ZRANGE', KEYS[2], 0, -1)
+for _, gif in ipairs(gifs) do
+    local id = string.sub(gif, 5)
+    redis.call('DEL', gif, 'votesForGif:' .. id, 'voteCountsForGif:' .. id)
+end
+redis.call('DEL', KEYS[1], KEYS[2], KEYS[4], KEYS[5], KEYS[7])
+redis.call('ZREM', KEYS[3], KEYS[1])
+redis.call('ZREM', KEYS[6], KEYS[1])
+return #gifs
+`)
+
+// voteScript replaces a user's vote on a gif, kept in the votesForGif:{id}
+// hash, adjusting the up and down counts in voteCountsForGif:{id} and the
+// gif's score on its group's leaderboard to match. It returns the new counts,
+// or nil without voting if the gif has been deleted, so a vote racing the
+// delete can't leave votes or a leaderboard entry behind.
+var voteScript = redis.NewScript(4, `
+if redis.call('EXISTS', KEYS[4]) == 0 then
+    return false
+end
+local previous = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+local vote = tonumber(ARGV[2])
+if previous ~= vote then
+    if previous == 1 then
+        redis.call('HINCRBY', KEYS[2], 'up', -1)
+    elseif previous == -1 then
+        redis.call('HINCRBY', KEYS[2], 'down', -1)
+    end
+    if vote == 1 then
+        redis.call('HINCRBY', KEYS[2], 'up', 1)
+    elseif vote == -1 then
+        redis.call('HINCRBY', KEYS[2], 'down', 1)
+    end
+
+    if vote == 0 then
+        redis.call('HDEL', KEYS[1], ARGV[1])
+    else
+        redis.call('HSET', KEYS[1], ARGV[1], vote)
+    end
+    redis.call('ZINCRBY', KEYS[3], vote - previous, KEYS[4])
+end
+return redis.call('HMGET', KEYS[2], 'up', 'down')
+`)
+
+// releaseObjectScript decrements an object's reference count. Once nothing
+// refers to the object it drops the field and marks the object as deleting,
+// in the same step, so no record can take a reference in between.
+var releaseObjectScript = redis.NewScript(2, `
+local refs = redis.call('HINCRBY', KEYS[1], ARGV[1], -1)
+if refs <= 0 then
+    redis.call('HDEL', KEYS[1], ARGV[1])
+    redis.call('SET', KEYS[2], 1, 'EX', ARGV[2])
+    return 0
+end
+return refs
+`)
+
+// objectRefs is a hash of blob object keys to the number of records using
+// them.
+const objectRefs = "refs:objects"
+
+// groupIndex is a sorted set of every group:{id} key, scored by creation
+// time, and groupIdIndex holds the same keys scored by id.
+const (
+    groupIndex   = "index:groups"
+    groupIdIndex = "index:groupIds"
+)
+
+// RedisStore keeps groups and gifs as JSON values under group:{id} and
+// gif:{id}. The groupIndex and gifsForGroup:{id} sorted sets track every
+// group and each group's gifs, scored by creation time, and groupIdIndex and
+// gifIdsForGroup:{id} the same scored by id, so that either order can be
+// paged in Redis. The leaderboardForGroup:{id} sorted sets each group's gifs
+// by their votes.
+type RedisStore struct {
+    pool *redis.Pool
+}
+
+func NewRedisStore(pool *redis.Pool) *RedisStore {
+    return &RedisStore{pool: pool}
+}
+
+// NewRedisPool returns a connection pool for the Redis server at addr, tuned
+// by the REDIS_* environment variables.
+func NewRedisPool(addr string) *redis.Pool {
+    connectTimeout := envDuration("REDIS_CONNECT_TIMEOUT", time.Second)
+    readTimeout := envDuration("REDIS_READ_TIMEOUT", time.Second)
+    writeTimeout := envDuration("REDIS_WRITE_TIMEOUT", time.Second)
+
+    return &redis.Pool{
+        MaxIdle:     envInt("REDIS_MAX_IDLE", 10),
+        MaxActive:   envInt("REDIS_MAX_ACTIVE", 100),
+        IdleTimeout: envDuration("REDIS_IDLE_TIMEOUT", 4*time.Minute),
+        Dial: func() (redis.Conn, error) {
+            return redis.Dial("tcp", addr,
+                redis.DialConnectTimeout(connectTimeout),
+                redis.DialReadTimeout(readTimeout),
+                redis.DialWriteTimeout(writeTimeout))
+        },
+        TestOnBorrow: func(c redis.Conn, t time.Time) error {
+            if time.Since(t) < time.Minute { // recently used, assume healthy
+                return nil
+            }
+            _, err := c.Do("PING")
+            return err
+        },
+    }
+}
+
+// conn borrows a connection from the pool. The caller must close it.
+func (s *RedisStore) conn() (redis.Conn, error) {
+    rC := s.pool.Get()
+    if err := rC.Err(); err != nil {
+        rC.Close()
+        log.Println("redis:", err)
+        return nil, ErrStoreUnavailable
+    }
+    return rC, nil
+}
+
+func (s *RedisStore) Status() StoreStatus {
+    status := StoreStatus{
+        Backend: "redis",
+        Healthy: true,
+        Pool: &PoolStats{
+            ActiveCount: s.pool.ActiveCount(),
+            MaxIdle:     s.pool.MaxIdle,
+            MaxActive:   s.pool.MaxActive,
+        },
+    }
+
+    rC, err := s.conn()
+    if err == nil {
+        defer rC.Close()
+        _, err = rC.Do("PING")
+    }
+    if err != nil {
+        status.Healthy = false
+        status.Error = err.Error()
+    }
+
+    return status
+}
+
+func (s *RedisStore) NextGroupId() (int, error) {
+    return s.nextId("id:groups")
+}
+
+func (s *RedisStore) NextGifId() (int, error) {
+    return s.nextId("id:gifs")
+}
+
+func (s *RedisStore) nextId(key string) (int, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return 0, StoreError(ErrCodeSave, "Error allocating id", err)
+    }
+    defer rC.Close()
+
+    id, err := redis.Int(rC.Do("INCR", key))
+    return id, StoreError(ErrCodeSave, "Error allocating id", err)
+}
+
+func (s *RedisStore) FindGroup(id int) (*Group, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return nil, StoreError(ErrCodeFind, "Error finding group", err)
+    }
+    defer rC.Close()
+
+    var group Group
+    found, err := s.get(rC, "group:"+strconv.Itoa(id), &group)
+    if err != nil {
+        return nil, err
+    }
+    if !found {
+        return nil, NewNotFoundError("Group not found")
+    }
+    return &group, nil
+}
+
+func (s *RedisStore) FindAllGroups(q ListQuery) (Groups, Page, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return nil, Page{}, StoreError(ErrCodeFind, "Error finding groups", err)
+    }
+    defer rC.Close()
+
+    groupKeys, page, err := s.page(rC, groupIndex, groupIdIndex, "group:", q)
+    if err != nil {
+        return nil, Page{}, StoreError(ErrCodeFind, "Error finding groups", err)
+    }
+
+    var groups Groups
+    err = s.getAll(rC, groupKeys, func(result interface{}) error {
+        var group Group
+        if err := decode(result, &group); err != nil {
+            return err
+        }
+        groups = append(groups, group)
+        return nil
+    })
+    if err != nil {
+        return nil, Page{}, StoreError(ErrCodeFind, "Error finding groups", err)
+    }
+
+    return groups, page, nil
+}
+
+func (s *RedisStore) FindGroupGifs(groupId int, q ListQuery) (Gifs, Page, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return nil, Page{}, StoreError(ErrCodeFind, "Error finding group gifs", err)
+    }
+    defer rC.Close()
+
+    gifKeys, page, err := s.page(rC, "gifsForGroup:"+strconv.Itoa(groupId), "gifIdsForGroup:"+strconv.Itoa(groupId), "gif:", q)
+    if err != nil {
+        return nil, Page{}, StoreError(ErrCodeFind, "Error finding group gifs", err)
+    }
+
+    var gifs Gifs
+    err = s.getAll(rC, gifKeys, func(result interface{}) error {
+        var gif Gif
+        if err := decode(result, &gif); err != nil {
+            return err
+        }
+        gifs = append(gifs, gif)
+        return nil
+    })
+    if err == nil {
+        err = s.loadVotes(rC, gifs)
+    }
+    if err != nil {
+        return nil, Page{}, StoreError(ErrCodeFind, "Error finding group gifs", err)
+    }
+
+    return gifs, page, nil
+}
+
+// page reads the keys on one page of a list of records, whose keys start
+// with prefix. index holds the keys scored by createdScore, and idIndex the
+// same keys scored by id.
+func (s *RedisStore) page(rC redis.Conn, index, idIndex, prefix string, q ListQuery) ([]interface{}, Page, error) {
+    total, err := redis.Int(rC.Do("ZCARD", index))
+    if err != nil {
+        return nil, Page{}, err
+    }
+
+    var items []ListItem
+    var next string
+    if q.Sort == SortByCreated {
+        items, next, err = s.pageByScore(rC, index, prefix, q)
+    } else {
+        items, next, err = s.pageById(rC, idIndex, prefix, q)
+    }
+    if err != nil {
+        return nil, Page{}, err
+    }
+
+    keys := make([]interface{}, len(items))
+    for i, item := range items {
+        keys[i] = prefix + strconv.Itoa(item.Id)
+    }
+    return keys, Page{NextCursor: next, Total: &total}, nil
+}
+
+// pageByScore reads the page after q.After straight from the index. Members
+// sharing a score are ordered lexicographically by Redis, so the cursor's
+// own score is re-read and everything up to the cursor member skipped.
+func (s *RedisStore) pageByScore(rC redis.Conn, index, prefix string, q ListQuery) ([]ListItem, string, error) {
+    cmd, from, to := "ZRANGEBYSCORE", "-inf", "+inf"
+    if q.Desc {
+        cmd, from, to = "ZREVRANGEBYSCORE", "+inf", "-inf"
+    }
+
+    var afterMember string
+    if q.After != nil {
+        from = strconv.FormatInt(q.After.Score, 10)
+        afterMember = prefix + strconv.Itoa(q.After.Id)
+    }
+
+    var items []ListItem
+    for offset := 0; len(items) <= q.Limit; offset += q.Limit + 1 {
+        reply, err := redis.Strings(rC.Do(cmd, index, from, to, "WITHSCORES", "LIMIT", offset, q.Limit+1))
+        if err != nil {
+            return nil, "", err
+        }
+        batch, err := indexItems(reply, prefix)
+        if err != nil {
+            return nil, "", err
+        }
+
+        for i, item := range batch {
+            member := reply[2*i]
+            if q.After != nil && item.Score == q.After.Score &&
+                (member == afterMember || (member < afterMember) != q.Desc) {
+                continue // at or before the cursor
+            }
+            items = append(items, item)
+        }
+
+        if len(batch) < q.Limit+1 {
+            break
+        }
+    }
+
+    if len(items) > q.Limit {
+        return items[:q.Limit], q.Cursor(items[q.Limit-1]), nil
+    }
+    return items, "", nil
+}
+
+// pageById reads the page after q.After from an index scored by id. Ids are
+// unique, so the page starts just past the cursor's own score.
+func (s *RedisStore) pageById(rC redis.Conn, idIndex, prefix string, q ListQuery) ([]ListItem, string, error) {
+    cmd, from, to := "ZRANGEBYSCORE", "-inf", "+inf"
+    if q.Desc {
+        cmd, from, to = "ZREVRANGEBYSCORE", "+inf", "-inf"
+    }
+    if q.After != nil {
+        from = "(" + strconv.Itoa(q.After.Id)
+    }
+
+    reply, err := redis.Strings(rC.Do(cmd, idIndex, from, to, "WITHSCORES", "LIMIT", 0, q.Limit+1))
+    if err != nil {
+        return nil, "", err
+    }
+    items, err := indexItems(reply, prefix)
+    if err != nil {
+        return nil, "", err
+    }
+
+    if len(items) > q.Limit {
+        return items[:q.Limit], q.Cursor(items[q.Limit-1]), nil
+    }
+    return items, "", nil
+}
+
+// indexItems decodes the reply of a WITHSCORES range over an index.
+func indexItems(reply []string, prefix string) ([]ListItem, error) {
+    items := make([]ListItem, 0, len(reply)/2)
+    for i := 0; i+1 < len(reply); i += 2 {
+        id, err := strconv.Atoi(strings.TrimPrefix(reply[i], prefix))
+        if err != nil {
+            return nil, err
+        }
+        score, err := strconv.ParseFloat(reply[i+1], 64)
+        if err != nil {
+            return nil, err
+        }
+        items = append(items, ListItem{Id: id, Score: int64(score)})
+    }
+    return items, nil
+}
+
+// getAll reads the records at keys with a single MGET and passes each one
+// that still exists to fn.
+func (s *RedisStore) getAll(rC redis.Conn, keys []interface{}, fn func(result interface{}) error) error {
+    if len(keys) == 0 {
+        return nil
+    }
+
+    results, err := redis.Values(rC.Do("MGET", keys...))
+    if err != nil {
+        return err
+    }
+
+    for _, result := range results {
+        if result == nil { // deleted since the index was read
+            continue
+        }
+        if err := fn(result); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (s *RedisStore) FindGif(id int) (*Gif, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return nil, StoreError(ErrCodeFind, "Error finding gif", err)
+    }
+    defer rC.Close()
+
+    var gif Gif
+    found, err := s.get(rC, "gif:"+strconv.Itoa(id), &gif)
+    if err != nil {
+        return nil, err
+    }
+    if !found {
+        return nil, NewNotFoundError("Gif not found")
+    }
+
+    gifs := Gifs{gif}
+    err = s.loadVotes(rC, gifs)
+    if err != nil {
+        return nil, StoreError(ErrCodeFind, "Error finding gif", err)
+    }
+    return &gifs[0], nil
+}
+
+// loadVotes fills in the vote counts of gifs. They are kept apart from the
+// gif records, so that voting never rewrites a gif.
+func (s *RedisStore) loadVotes(rC redis.Conn, gifs Gifs) error {
+    for _, gif := range gifs {
+        rC.Send("HMGET", "voteCountsForGif:"+strconv.Itoa(gif.Id), "up", "down")
+    }
+    if err := rC.Flush(); err != nil {
+        return err
+    }
+
+    for i := range gifs {
+        counts, err := redis.Values(rC.Receive())
+        if err != nil {
+            return err
+        }
+        gifs[i].Upvotes, gifs[i].Downvotes = 0, 0
+        _, err = redis.Scan(counts, &gifs[i].Upvotes, &gifs[i].Downvotes)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// get decodes the JSON record stored at key into v. It reports false, rather
+// than an error, when the key does not exist.
+func (s *RedisStore) get(rC redis.Conn, key interface{}, v interface{}) (bool, error) {
+    result, err := redis.Bytes(rC.Do("GET", key))
+    if err == redis.ErrNil {
+        return false, nil
+    }
+    if err != nil {
+        return false, StoreError(ErrCodeFind, "Error reading record", err)
+    }
+
+    return true, decode(result, v)
+}
+
+// decode unmarshals a JSON record read from Redis into v.
+func decode(result interface{}, v interface{}) error {
+    data, err := redis.Bytes(result, nil)
+    if err == nil {
+        err = json.Unmarshal(data, v)
+    }
+    if err != nil {
+        return NewInternalError(ErrCodeCorrupt, "Corrupt record", err)
+    }
+    return nil
+}
+
+func (s *RedisStore) SaveGroup(g *Group) error {
+    rC, err := s.conn()
+    if err != nil {
+        return StoreError(ErrCodeSave, "Error saving group", err)
+    }
+    defer rC.Close()
+
+    gJson, err := json.Marshal(g)
+    if err != nil {
+        return NewInternalError(ErrCodeSave, "Error encoding group", err)
+    }
+
+    groupKey := "group:" + strconv.Itoa(g.Id)
+    rC.Send("MULTI")
+    rC.Send("SET", groupKey, gJson)
+    rC.Send("ZADD", groupIndex, groupScore(g), groupKey)
+    rC.Send("ZADD", groupIdIndex, g.Id, groupKey)
+    _, err = rC.Do("EXEC")
+    return StoreError(ErrCodeSave, "Error saving group", err)
+}
+
+func (s *RedisStore) SaveGif(gif *Gif) error {
+    rC, err := s.conn()
+    if err != nil {
+        return StoreError(ErrCodeSave, "Error saving gif", err)
+    }
+    defer rC.Close()
+
+    gifJson, err := json.Marshal(gif)
+    if err != nil {
+        return NewInternalError(ErrCodeSave, "Error encoding gif", err)
+    }
+
+    rC.Send("MULTI")
+    rC.Send("SET", "gif:"+strconv.Itoa(gif.Id), gifJson)
+    rC.Send("ZADD", "gifsForGroup:"+strconv.Itoa(gif.GroupId), gifScore(gif), "gif:"+strconv.Itoa(gif.Id))
+    rC.Send("ZADD", "gifIdsForGroup:"+strconv.Itoa(gif.GroupId), gif.Id, "gif:"+strconv.Itoa(gif.Id))
+    rC.Send("ZADD", "leaderboardForGroup:"+strconv.Itoa(gif.GroupId), "NX", 0, "gif:"+strconv.Itoa(gif.Id))
+    _, err = rC.Do("EXEC")
+    return StoreError(ErrCodeSave, "Error saving gif", err)
+}
+
+func (s *RedisStore) MoveGif(gif *Gif, groupId int) error {
+    rC, err := s.conn()
+    if err != nil {
+        return StoreError(ErrCodeSave, "Error moving gif", err)
+    }
+    defer rC.Close()
+
+    fromGroupId := gif.GroupId
+    gif.GroupId = groupId
+    gifJson, err := json.Marshal(gif)
+    if err != nil {
+        gif.GroupId = fromGroupId
+        return NewInternalError(ErrCodeSave, "Error encoding gif", err)
+    }
+
+    gifKey := "gif:" + strconv.Itoa(gif.Id)
+    rC.Send("MULTI")
+    rC.Send("SET", gifKey, gifJson)
+    rC.Send("ZREM", "gifsForGroup:"+strconv.Itoa(fromGroupId), gifKey)
+    rC.Send("ZADD", "gifsForGroup:"+strconv.Itoa(groupId), gifScore(gif), gifKey)
+    rC.Send("ZREM", "gifIdsForGroup:"+strconv.Itoa(fromGroupId), gifKey)
+    rC.Send("ZADD", "gifIdsForGroup:"+strconv.Itoa(groupId), gif.Id, gifKey)
+    rC.Send("ZREM", "leaderboardForGroup:"+strconv.Itoa(fromGroupId), gifKey)
+    rC.Send("ZADD", "leaderboardForGroup:"+strconv.Itoa(groupId), GifScore(gif), gifKey)
+    _, err = rC.Do("EXEC")
+    if err != nil {
+        gif.GroupId = fromGroupId
+    }
+    return StoreError(ErrCodeSave, "Error moving gif", err)
+}
+
+func (s *RedisStore) DeleteGroup(id int) error {
+    rC, err := s.conn()
+    if err != nil {
+        return StoreError(ErrCodeSave, "Error deleting group", err)
+    }
+    defer rC.Close()
+
+    _, err = deleteGroupScript.Do(rC, "group:"+strconv.Itoa(id), "gifsForGroup:"+strconv.Itoa(id), groupIndex,
+        "membersForGroup:"+strconv.Itoa(id), "leaderboardForGroup:"+strconv.Itoa(id),
+        groupIdIndex, "gifIdsForGroup:"+strconv.Itoa(id))
+    return StoreError(ErrCodeSave, "Error deleting group", err)
+}
+
+func (s *RedisStore) DeleteGif(gif *Gif) error {
+    rC, err := s.conn()
+    if err != nil {
+        return StoreError(ErrCodeSave, "Error deleting gif", err)
+    }
+    defer rC.Close()
+
+    gifKey := "gif:" + strconv.Itoa(gif.Id)
+    rC.Send("MULTI")
+    rC.Send("DEL", gifKey, "votesForGif:"+strconv.Itoa(gif.Id), "voteCountsForGif:"+strconv.Itoa(gif.Id))
+    rC.Send("ZREM", "gifsForGroup:"+strconv.Itoa(gif.GroupId), gifKey)
+    rC.Send("ZREM", "gifIdsForGroup:"+strconv.Itoa(gif.GroupId), gifKey)
+    rC.Send("ZREM", "leaderboardForGroup:"+strconv.Itoa(gif.GroupId), gifKey)
+    _, err = rC.Do("EXEC")
+    return StoreError(ErrCodeSave, "Error deleting gif", err)
+}
+
+func (s *RedisStore) RetainObject(key string) error {
+    rC, err := s.conn()
+    if err != nil {
+        return StoreError(ErrCodeSave, "Error saving image reference", err)
+    }
+    defer rC.Close()
+
+    _, err = rC.Do("HINCRBY", objectRefs, key, 1)
+    return StoreError(ErrCodeSave, "Error saving image reference", err)
+}
+
+func (s *RedisStore) ReleaseObject(key string) (int, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return 0, StoreError(ErrCodeSave, "Error releasing image reference", err)
+    }
+    defer rC.Close()
+
+    ttl := int(objectDeletingTTL / time.Second)
+    refs, err := redis.Int(releaseObjectScript.Do(rC, objectRefs, "deleting:"+key, key, ttl))
+    return refs, StoreError(ErrCodeSave, "Error releasing image reference", err)
+}
+
+func (s *RedisStore) ObjectDeleting(key string) (bool, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return false, StoreError(ErrCodeFind, "Error finding image", err)
+    }
+    defer rC.Close()
+
+    deleting, err := redis.Bool(rC.Do("EXISTS", "deleting:"+key))
+    return deleting, StoreError(ErrCodeFind, "Error finding image", err)
+}
+
+func (s *RedisStore) ObjectDeleted(key string) error {
+    rC, err := s.conn()
+    if err != nil {
+        return StoreError(ErrCodeSave, "Error releasing image", err)
+    }
+    defer rC.Close()
+
+    _, err = rC.Do("DEL", "deleting:"+key)
+    return StoreError(ErrCodeSave, "Error releasing image", err)
+}
+
+func (s *RedisStore) NextUserId() (int, error) {
+    return s.nextId("id:users")
+}
+
+func (s *RedisStore) FindUser(id int) (*User, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return nil, StoreError(ErrCodeFind, "Error finding user", err)
+    }
+    defer rC.Close()
+
+    var user User
+    found, err := s.get(rC, "user:"+strconv.Itoa(id), &user)
+    if err != nil {
+        return nil, err
+    }
+    if !found {
+        return nil, NewNotFoundError("User not found")
+    }
+    return &user, nil
+}
+
+func (s *RedisStore) SaveUser(u *User) error {
+    return s.set("user:"+strconv.Itoa(u.Id), u, "user")
+}
+
+func (s *RedisStore) FindApiKey(id string) (*ApiKey, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return nil, StoreError(ErrCodeFind, "Error finding API key", err)
+    }
+    defer rC.Close()
+
+    var key ApiKey
+    found, err := s.get(rC, "apikey:"+id, &key)
+    if err != nil {
+        return nil, err
+    }
+    if !found {
+        return nil, NewNotFoundError("API key not found")
+    }
+    return &key, nil
+}
+
+func (s *RedisStore) SaveApiKey(k *ApiKey) error {
+    return s.set("apikey:"+k.Id, k, "API key")
+}
+
+func (s *RedisStore) DeleteApiKey(id string) error {
+    rC, err := s.conn()
+    if err != nil {
+        return StoreError(ErrCodeSave, "Error deleting API key", err)
+    }
+    defer rC.Close()
+
+    _, err = rC.Do("DEL", "apikey:"+id)
+    return StoreError(ErrCodeSave, "Error deleting API key", err)
+}
+
+func (s *RedisStore) VoteGif(gif *Gif, userId, vote int) error {
+    rC, err := s.conn()
+    if err != nil {
+        return StoreError(ErrCodeSave, "Error saving vote", err)
+    }
+    defer rC.Close()
+
+    counts, err := redis.Values(voteScript.Do(rC, "votesForGif:"+strconv.Itoa(gif.Id), "voteCountsForGif:"+strconv.Itoa(gif.Id),
+        "leaderboardForGroup:"+strconv.Itoa(gif.GroupId), "gif:"+strconv.Itoa(gif.Id), userId, vote))
+    if err == redis.ErrNil {
+        return NewNotFoundError("Gif not found")
+    }
+    if err == nil {
+        gif.Upvotes, gif.Downvotes = 0, 0
+        _, err = redis.Scan(counts, &gif.Upvotes, &gif.Downvotes)
+    }
+    return StoreError(ErrCodeSave, "Error saving vote", err)
+}
+
+func (s *RedisStore) FindGroupLeaderboard(groupId, limit int) (Gifs, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return nil, StoreError(ErrCodeFind, "Error finding leaderboard", err)
+    }
+    defer rC.Close()
+
+    gifKeys, err := redis.Values(rC.Do("ZREVRANGE", "leaderboardForGroup:"+strconv.Itoa(groupId), 0, limit-1))
+    if err != nil {
+        return nil, StoreError(ErrCodeFind, "Error finding leaderboard", err)
+    }
+
+    gifs := Gifs{}
+    err = s.getAll(rC, gifKeys, func(result interface{}) error {
+        var gif Gif
+        if err := decode(result, &gif); err != nil {
+            return err
+        }
+        gifs = append(gifs, gif)
+        return nil
+    })
+    if err == nil {
+        err = s.loadVotes(rC, gifs)
+    }
+    if err != nil {
+        return nil, StoreError(ErrCodeFind, "Error finding leaderboard", err)
+    }
+    return gifs, nil
+}
+
+func (s *RedisStore) AddGroupMember(groupId, userId int) error {
+    rC, err := s.conn()
+    if err != nil {
+        return StoreError(ErrCodeSave, "Error adding member", err)
+    }
+    defer rC.Close()
+
+    _, err = rC.Do("SADD", "membersForGroup:"+strconv.Itoa(groupId), userId)
+    return StoreError(ErrCodeSave, "Error adding member", err)
+}
+
+func (s *RedisStore) RemoveGroupMember(groupId, userId int) error {
+    rC, err := s.conn()
+    if err != nil {
+        return StoreError(ErrCodeSave, "Error removing member", err)
+    }
+    defer rC.Close()
+
+    _, err = rC.Do("SREM", "membersForGroup:"+strconv.Itoa(groupId), userId)
+    return StoreError(ErrCodeSave, "Error removing member", err)
+}
+
+func (s *RedisStore) IsGroupMember(groupId, userId int) (bool, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return false, StoreError(ErrCodeFind, "Error finding member", err)
+    }
+    defer rC.Close()
+
+    member, err := redis.Bool(rC.Do("SISMEMBER", "membersForGroup:"+strconv.Itoa(groupId), userId))
+    return member, StoreError(ErrCodeFind, "Error finding member", err)
+}
+
+func (s *RedisStore) FindGroupMembers(groupId int) ([]int, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return nil, StoreError(ErrCodeFind, "Error finding members", err)
+    }
+    defer rC.Close()
+
+    ids, err := redis.Ints(rC.Do("SMEMBERS", "membersForGroup:"+strconv.Itoa(groupId)))
+    if err != nil {
+        return nil, StoreError(ErrCodeFind, "Error finding members", err)
+    }
+    sort.Ints(ids)
+    return ids, nil
+}
+
+func (s *RedisStore) SaveInvite(inv *Invite, ttl time.Duration) error {
+    rC, err := s.conn()
+    if err != nil {
+        return StoreError(ErrCodeSave, "Error saving invite", err)
+    }
+    defer rC.Close()
+
+    invJson, err := json.Marshal(inv)
+    if err != nil {
+        return NewInternalError(ErrCodeSave, "Error encoding invite", err)
+    }
+
+    _, err = rC.Do("SET", "invite:"+inv.Code, invJson, "EX", int(ttl/time.Second))
+    return StoreError(ErrCodeSave, "Error saving invite", err)
+}
+
+func (s *RedisStore) FindInvite(code string) (*Invite, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return nil, StoreError(ErrCodeFind, "Error finding invite", err)
+    }
+    defer rC.Close()
+
+    var inv Invite
+    found, err := s.get(rC, "invite:"+code, &inv)
+    if err != nil {
+        return nil, err
+    }
+    if !found {
+        return nil, NewNotFoundError("Invite not found")
+    }
+    return &inv, nil
+}
+
+func (s *RedisStore) DeleteInvite(code string) error {
+    rC, err := s.conn()
+    if err != nil {
+        return StoreError(ErrCodeSave, "Error deleting invite", err)
+    }
+    defer rC.Close()
+
+    _, err = rC.Do("DEL", "invite:"+code)
+    return StoreError(ErrCodeSave, "Error deleting invite", err)
+}
+
+func (s *RedisStore) RevokeToken(jti string, ttl time.Duration) (bool, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return false, StoreError(ErrCodeSave, "Error revoking token", err)
+    }
+    defer rC.Close()
+
+    // Rounded up, since an expiry of 0 seconds is an error. NX leaves a
+    // token that is already revoked alone, replying nil.
+    reply, err := rC.Do("SET", "revoked:"+jti, 1, "EX", int((ttl+time.Second-1)/time.Second), "NX")
+    return reply != nil, StoreError(ErrCodeSave, "Error revoking token", err)
+}
+
+func (s *RedisStore) IsTokenRevoked(jti string) (bool, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return false, StoreError(ErrCodeFind, "Error checking token", err)
+    }
+    defer rC.Close()
+
+    revoked, err := redis.Bool(rC.Do("EXISTS", "revoked:"+jti))
+    return revoked, StoreError(ErrCodeFind, "Error checking token", err)
+}
+
+// set stores v as JSON at key. name describes the record in errors.
+func (s *RedisStore) set(key string, v interface{}, name string) error {
+    rC, err := s.conn()
+    if err != nil {
+        return StoreError(ErrCodeSave, "Error saving "+name, err)
+    }
+    defer rC.Close()
+
+    vJson, err := json.Marshal(v)
+    if err != nil {
+        return NewInternalError(ErrCodeSave, "Error encoding "+name, err)
+    }
+
+    _, err = rC.Do("SET", key, vJson)
+    return StoreError(ErrCodeSave, "Error saving "+name, err)
+}
+
+func (s *RedisStore) SavePendingUpload(u *PendingUpload, ttl time.Duration) error {
+    rC, err := s.conn()
+    if err != nil {
+        return StoreError(ErrCodeSave, "Error saving upload", err)
+    }
+    defer rC.Close()
+
+    uJson, err := json.Marshal(u)
+    if err != nil {
+        return NewInternalError(ErrCodeSave, "Error encoding upload", err)
+    }
+
+    _, err = rC.Do("SET", "upload:"+u.Id, uJson, "EX", int(ttl/time.Second))
+    return StoreError(ErrCodeSave, "Error saving upload", err)
+}
+
+func (s *RedisStore) FindPendingUpload(id string) (*PendingUpload, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return nil, StoreError(ErrCodeFind, "Error finding upload", err)
+    }
+    defer rC.Close()
+
+    var u PendingUpload
+    found, err := s.get(rC, "upload:"+id, &u)
+    if err != nil {
+        return nil, err
+    }
+    if !found {
+        return nil, NewNotFoundError("Upload not found")
+    }
+    return &u, nil
+}
+
+func (s *RedisStore) DeletePendingUpload(id string) (bool, error) {
+    rC, err := s.conn()
+    if err != nil {
+        return false, StoreError(ErrCodeSave, "Error deleting upload", err)
+    }
+    defer rC.Close()
+
+    deleted, err := redis.Int(rC.Do("DEL", "upload:"+id))
+    return deleted > 0, StoreError(ErrCodeSave, "Error deleting upload", err)
+}
+
+// Migrate upgrades data written by earlier versions: it builds groupIndex and
+// groupIdIndex from the existing group:{id} keys, converts gifsForGroup:{id}
+// sets into sorted sets, and builds the gifIdsForGroup:{id} and leaderboard
+// sets from them. It scans the keyspace incrementally, so it is safe to run
+// against a live server.
+func (s *RedisStore) Migrate() error {
+    rC, err := s.conn()
+    if err != nil {
+        return err
+    }
+    defer rC.Close()
+
+    err = s.scan(rC, "group:*", func(keys []interface{}) error {
+        args, idArgs := redis.Args{}.Add(groupIndex), redis.Args{}.Add(groupIdIndex)
+        err := s.getAll(rC, keys, func(result interface{}) error {
+            var group Group
+            if err := decode(result, &group); err != nil {
+                return err
+            }
+            args = args.Add(groupScore(&group), "group:"+strconv.Itoa(group.Id))
+            idArgs = idArgs.Add(group.Id, "group:"+strconv.Itoa(group.Id))
+            return nil
+        })
+        if err != nil || len(args) == 1 {
+            return err
+        }
+
+        rC.Send("MULTI")
+        rC.Send("ZADD", args...)
+        rC.Send("ZADD", idArgs...)
+        _, err = rC.Do("EXEC")
+        return err
+    })
+    if err != nil {
+        return err
+    }
+
+    err = s.scan(rC, "gifsForGroup:*", func(keys []interface{}) error {
+        for _, key := range keys {
+            if err := s.migrateGifSet(rC, key); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    return s.scan(rC, "gifsForGroup:*", func(keys []interface{}) error {
+        for _, key := range keys {
+            if err := s.migrateGifIndexes(rC, key); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// migrateGifIndexes adds the gifs of a gifsForGroup:{id} sorted set to the
+// group's gifIdsForGroup:{id} set, and those saved before voting to its
+// leaderboard, with no votes.
+func (s *RedisStore) migrateGifIndexes(rC redis.Conn, key interface{}) error {
+    gifKeys, err := redis.Strings(rC.Do("ZRANGE", key, 0, -1))
+    if err != nil || len(gifKeys) == 0 {
+        return err
+    }
+
+    groupId := strings.TrimPrefix(string(key.([]byte)), "gifsForGroup:")
+    args := redis.Args{}.Add("leaderboardForGroup:"+groupId, "NX")
+    idArgs := redis.Args{}.Add("gifIdsForGroup:" + groupId)
+    for _, gifKey := range gifKeys {
+        id, err := strconv.Atoi(strings.TrimPrefix(gifKey, "gif:"))
+        if err != nil {
+            return err
+        }
+        args = args.Add(0, gifKey)
+        idArgs = idArgs.Add(id, gifKey)
+    }
+
+    rC.Send("MULTI")
+    rC.Send("ZADD", args...)
+    rC.Send("ZADD", idArgs...)
+    _, err = rC.Do("EXEC")
+    return err
+}
+
+// migrateGifSet replaces a plain gifsForGroup:{id} set with a sorted set.
+func (s *RedisStore) migrateGifSet(rC redis.Conn, key interface{}) error {
+    keyType, err := redis.String(rC.Do("TYPE", key))
+    if err != nil || keyType != "set" {
+        return err
+    }
+
+    gifKeys, err := redis.Values(rC.Do("SMEMBERS", key))
+    if err != nil {
+        return err
+    }
+
+    args := redis.Args{}.Add(key)
+    err = s.getAll(rC, gifKeys, func(result interface{}) error {
+        var gif Gif
+        if err := decode(result, &gif); err != nil {
+            return err
+        }
+        args = args.Add(gifScore(&gif), "gif:"+strconv.Itoa(gif.Id))
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    rC.Send("MULTI")
+    rC.Send("DEL", key)
+    if len(args) > 1 {
+        rC.Send("ZADD", args...)
+    }
+    _, err = rC.Do("EXEC")
+    return err
+}
+
+// scan passes every key matching pattern to fn, a batch at a time.
+func (s *RedisStore) scan(rC redis.Conn, pattern string, fn func(keys []interface{}) error) error {
+    cursor := "0"
+    for {
+        reply, err := redis.Values(rC.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 100))
+        if err != nil {
+            return err
+        }
+
+        cursor, err = redis.String(reply[0], nil)
+        if err != nil {
+            return err
+        }
+        keys, err := redis.Values(reply[1], nil)
+        if err != nil {
+            return err
+        }
+
+        if len(keys) > 0 {
+            if err := fn(keys); err != nil {
+                return err
+            }
+        }
+
+        if cursor == "0" {
+            return nil
+        }
+    }
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha1"
+    "encoding/base64"
+    "io"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+
+    "github.com/mitchellh/goamz/aws"
+    "github.com/mitchellh/goamz/s3"
+)
+
+// s3PartSize is how much of a streamed upload is held in memory before it is
+// sent as one part of a multipart upload. S3 requires every part but the last
+// to be at least 5MB.
+const s3PartSize = 5 << 20
+
+// S3BlobStore stores objects in an S3 bucket, publicly readable unless
+// isPrivatePath says otherwise.
+type S3BlobStore struct {
+    bucket *s3.Bucket
+}
+
+func NewS3BlobStore(bucketName string) (*S3BlobStore, error) {
+    auth, err := aws.EnvAuth()
+    if err != nil {
+        return nil, err
+    }
+
+    client := s3.New(auth, aws.USEast)
+    return &S3BlobStore{bucket: client.Bucket(bucketName)}, nil
+}
+
+// s3ACL returns the canned ACL for the object at path.
+func s3ACL(path string) s3.ACL {
+    if isPrivatePath(path) {
+        return s3.Private
+    }
+    return s3.PublicRead
+}
+
+func (s *S3BlobStore) Put(path string, data []byte, contentType string) error {
+    return BlobError("Error uploading image to storage", s.bucket.Put(path, data, contentType, s3ACL(path)))
+}
+
+func (s *S3BlobStore) Writer(path string, contentType string) (BlobWriter, error) {
+    return &s3Writer{bucket: s.bucket, path: path, contentType: contentType}, nil
+}
+
+func (s *S3BlobStore) Copy(from, to string) error {
+    return BlobError("Error copying image in storage", s.bucket.Copy(from, to, s3ACL(to)))
+}
+
+func (s *S3BlobStore) Get(path string) ([]byte, error) {
+    data, err := s.bucket.Get(path)
+    return data, BlobError("Error reading image from storage", err)
+}
+
+func (s *S3BlobStore) Reader(path string) (io.ReadCloser, error) {
+    r, err := s.bucket.GetReader(path)
+    return r, BlobError("Error reading image from storage", err)
+}
+
+func (s *S3BlobStore) Exists(path string) (bool, error) {
+    res, err := s.bucket.Head(path)
+    if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == http.StatusNotFound {
+        return false, nil
+    }
+    if err != nil {
+        return false, BlobError("Error reading image from storage", err)
+    }
+    res.Body.Close()
+    return true, nil
+}
+
+func (s *S3BlobStore) Delete(path string) error {
+    return BlobError("Error deleting image from storage", s.bucket.Del(path))
+}
+
+func (s *S3BlobStore) DeletePrefix(prefix string) error {
+    for {
+        list, err := s.bucket.List(prefix, "", "", 1000)
+        if err != nil {
+            return BlobError("Error listing images in storage", err)
+        }
+        if len(list.Contents) == 0 {
+            return nil
+        }
+
+        paths := make([]string, len(list.Contents))
+        for i, key := range list.Contents {
+            paths[i] = key.Key
+        }
+        if err := s.bucket.MultiDel(paths); err != nil {
+            return BlobError("Error deleting images from storage", err)
+        }
+
+        if !list.IsTruncated {
+            return nil
+        }
+    }
+}
+
+func (s *S3BlobStore) URL(path string) string {
+    return s.bucket.URL(path)
+}
+
+// SignedPutURL presigns a PUT with S3's query string authentication. goamz's
+// SignedURL can only presign GETs, so this builds the same signature for a
+// PUT, covering the content type and ACL the client must send.
+func (s *S3BlobStore) SignedPutURL(path, contentType string, expires time.Time) (string, map[string]string, error) {
+    auth := s.bucket.S3.Auth
+    acl := string(s3ACL(path))
+    headers := map[string]string{"Content-Type": contentType, "x-amz-acl": acl}
+    amzHeaders := "x-amz-acl:" + acl + "\n"
+    if len(auth.Token) > 0 {
+        headers["x-amz-security-token"] = auth.Token
+        amzHeaders += "x-amz-security-token:" + auth.Token + "\n"
+    }
+
+    expiresAt := strconv.FormatInt(expires.Unix(), 10)
+    payload := "PUT\n\n" + contentType + "\n" + expiresAt + "\n" + amzHeaders + "/" + s.bucket.Name + "/" + path
+    mac := hmac.New(sha1.New, []byte(auth.SecretKey))
+    mac.Write([]byte(payload))
+
+    u, err := url.Parse(s.bucket.URL(path))
+    if err != nil {
+        return "", nil, BlobError("Error signing upload", err)
+    }
+    u.RawQuery = url.Values{
+        "AWSAccessKeyId": {auth.AccessKey},
+        "Expires":        {expiresAt},
+        "Signature":      {base64.StdEncoding.EncodeToString(mac.Sum(nil))},
+    }.Encode()
+    return u.String(), headers, nil
+}
+
+// s3Writer buffers a file s3PartSize at a time. Files that fit in one buffer
+// are stored with a single PUT; larger ones start a multipart upload, which
+// S3 only assembles into the object on Complete.
+type s3Writer struct {
+    bucket      *s3.Bucket
+    path        string
+    contentType string
+    multi       *s3.Multi
+    parts       []s3.Part
+    buf         bytes.Buffer
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+    written := 0
+    for len(p) > 0 {
+        n := s3PartSize - w.buf.Len()
+        if n > len(p) {
+            n = len(p)
+        }
+        w.buf.Write(p[:n])
+        p = p[n:]
+        written += n
+
+        if w.buf.Len() == s3PartSize {
+            err := w.putPart()
+            if err != nil {
+                return written, err
+            }
+        }
+    }
+    return written, nil
+}
+
+func (w *s3Writer) putPart() error {
+    var err error
+    if w.multi == nil {
+        w.multi, err = w.bucket.InitMulti(w.path, w.contentType, s3ACL(w.path))
+        if err != nil {
+            return BlobError("Error uploading image to storage", err)
+        }
+    }
+
+    part, err := w.multi.PutPart(len(w.parts)+1, bytes.NewReader(w.buf.Bytes()))
+    if err != nil {
+        return BlobError("Error uploading image to storage", err)
+    }
+    w.parts = append(w.parts, part)
+    w.buf.Reset()
+    return nil
+}
+
+func (w *s3Writer) Close() error {
+    if w.multi == nil {
+        return BlobError("Error uploading image to storage", w.bucket.Put(w.path, w.buf.Bytes(), w.contentType, s3ACL(w.path)))
+    }
+
+    if w.buf.Len() > 0 {
+        err := w.putPart()
+        if err != nil {
+            return err
+        }
+    }
+    return BlobError("Error uploading image to storage", w.multi.Complete(w.parts))
+}
+
+// Abort discards the parts sent so far, which S3 would otherwise keep, and
+// bill for, indefinitely.
+func (w *s3Writer) Abort() error {
+    w.buf.Reset()
+    if w.multi == nil {
+        return nil
+    }
+    return BlobError("Error discarding upload", w.multi.Abort())
+}
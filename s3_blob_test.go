@@ -0,0 +1,333 @@
+package main
+
+import (
+    "bytes"
+    "crypto/md5"
+    "encoding/hex"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    "image/gif"
+    "io"
+    "io/ioutil"
+    "math/rand"
+    "mime/multipart"
+    "net/http"
+    "net/http/httptest"
+    "net/http/httputil"
+    "net/url"
+    "strconv"
+    "sync"
+    "testing"
+    "testing/iotest"
+    "time"
+
+    "github.com/mitchellh/goamz/aws"
+    "github.com/mitchellh/goamz/s3"
+    "github.com/mitchellh/goamz/s3/s3test"
+)
+
+// s3Multipart fronts an s3test server, which has no multipart uploads, with
+// as much of the multipart API as s3Writer uses. Parts are kept here, and
+// put to the server as one object on Complete. It also records the ACLs
+// objects are written with, which s3test ignores.
+type s3Multipart struct {
+    backend *url.URL
+    proxy   *httputil.ReverseProxy
+
+    mu        sync.Mutex
+    lastId    int
+    uploads   map[string]*s3Upload // by upload id
+    completed int
+    aborted   int
+    acls      map[string]string // by request path
+}
+
+type s3Upload struct {
+    contentType string
+    parts       map[int][]byte
+}
+
+func (s *s3Multipart) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+    s.mu.Lock()
+    if acl := req.Header.Get("x-amz-acl"); len(acl) > 0 {
+        s.acls[req.URL.Path] = acl
+    }
+    s.mu.Unlock()
+
+    query := req.URL.Query()
+    _, initiate := query["uploads"]
+    id := query.Get("uploadId")
+    if !initiate && len(id) == 0 {
+        s.proxy.ServeHTTP(w, req)
+        return
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if initiate {
+        s.lastId++
+        id = strconv.Itoa(s.lastId)
+        s.uploads[id] = &s3Upload{contentType: req.Header.Get("Content-Type"), parts: make(map[int][]byte)}
+        fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%v</UploadId></InitiateMultipartUploadResult>", id)
+        return
+    }
+
+    upload, ok := s.uploads[id]
+    if !ok {
+        http.Error(w, "<Error><Code>NoSuchUpload</Code></Error>", http.StatusNotFound)
+        return
+    }
+
+    switch req.Method {
+    case "PUT":
+        n, _ := strconv.Atoi(query.Get("partNumber"))
+        data, _ := ioutil.ReadAll(req.Body)
+        upload.parts[n] = data
+        sum := md5.Sum(data)
+        w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+    case "POST":
+        var complete struct {
+            Part []struct{ PartNumber int }
+        }
+        if err := xml.NewDecoder(req.Body).Decode(&complete); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        var object bytes.Buffer
+        for _, part := range complete.Part {
+            object.Write(upload.parts[part.PartNumber])
+        }
+
+        put, _ := http.NewRequest("PUT", s.backend.String()+req.URL.Path, &object)
+        put.Header.Set("Content-Type", upload.contentType)
+        res, err := http.DefaultClient.Do(put)
+        if err != nil || res.StatusCode != http.StatusOK {
+            http.Error(w, fmt.Sprintf("error putting object: %v", err), http.StatusInternalServerError)
+            return
+        }
+        res.Body.Close()
+        delete(s.uploads, id)
+        s.completed++
+        fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+    case "DELETE":
+        delete(s.uploads, id)
+        s.aborted++
+        w.WriteHeader(http.StatusNoContent)
+    }
+}
+
+// counts returns how many uploads were completed, aborted, and are still
+// open.
+func (s *s3Multipart) counts() (int, int, int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.completed, s.aborted, len(s.uploads)
+}
+
+// testS3 returns an S3BlobStore backed by an s3test server, and the
+// multipart shim in front of it.
+func testS3(t *testing.T) (*S3BlobStore, *s3Multipart) {
+    server, err := s3test.NewServer(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(server.Quit)
+
+    backend, err := url.Parse(server.URL())
+    if err != nil {
+        t.Fatal(err)
+    }
+    shim := &s3Multipart{
+        backend: backend,
+        proxy:   httputil.NewSingleHostReverseProxy(backend),
+        uploads: make(map[string]*s3Upload),
+        acls:    make(map[string]string),
+    }
+    front := httptest.NewServer(shim)
+    t.Cleanup(front.Close)
+
+    client := s3.New(aws.Auth{AccessKey: "abc", SecretKey: "123"}, aws.Region{Name: "faux-region-1", S3Endpoint: front.URL, S3LocationConstraint: true})
+    bucket := client.Bucket("gifs")
+    if err := bucket.PutBucket(s3.Private); err != nil {
+        t.Fatal(err)
+    }
+    return &S3BlobStore{bucket: bucket}, shim
+}
+
+// noiseGif encodes frames frames of random pixels, which barely compress.
+func noiseGif(t *testing.T, size, frames int) []byte {
+    palette := make(color.Palette, 256)
+    for i := range palette {
+        palette[i] = color.RGBA{uint8(i), uint8(i * 7), uint8(i * 13), 255}
+    }
+    random := rand.New(rand.NewSource(1))
+    g := &gif.GIF{}
+    for i := 0; i < frames; i++ {
+        img := image.NewPaletted(image.Rect(0, 0, size, size), palette)
+        random.Read(img.Pix)
+        g.Image = append(g.Image, img)
+        g.Delay = append(g.Delay, 10)
+    }
+
+    var b bytes.Buffer
+    if err := gif.EncodeAll(&b, g); err != nil {
+        t.Fatal(err)
+    }
+    return b.Bytes()
+}
+
+func TestS3WriterMultipart(t *testing.T) {
+    store, shim := testS3(t)
+
+    data := make([]byte, 2*s3PartSize+1000)
+    rand.New(rand.NewSource(1)).Read(data)
+
+    w, err := store.Writer("objects/big.gif", GifContentType)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := w.Write(data); err != nil {
+        t.Fatal(err)
+    }
+    if err := w.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    if completed, aborted, open := shim.counts(); completed != 1 || aborted != 0 || open != 0 {
+        t.Errorf("got %v completed, %v aborted and %v open uploads, want 1 completed", completed, aborted, open)
+    }
+    stored, err := store.Get("objects/big.gif")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(stored, data) {
+        t.Errorf("stored %v bytes, not the %v written", len(stored), len(data))
+    }
+}
+
+func TestS3WriterAbort(t *testing.T) {
+    store, shim := testS3(t)
+
+    w, err := store.Writer("objects/big.gif", GifContentType)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := w.Write(make([]byte, s3PartSize+1)); err != nil {
+        t.Fatal(err)
+    }
+    if err := w.Abort(); err != nil {
+        t.Fatal(err)
+    }
+
+    if completed, aborted, open := shim.counts(); completed != 0 || aborted != 1 || open != 0 {
+        t.Errorf("got %v completed, %v aborted and %v open uploads, want 1 aborted", completed, aborted, open)
+    }
+    exists, err := store.Exists("objects/big.gif")
+    if err != nil || exists {
+        t.Errorf("object exists %v, error %v", exists, err)
+    }
+}
+
+func TestS3PrivateUploads(t *testing.T) {
+    store, shim := testS3(t)
+
+    for _, path := range []string{"objects/small.gif", "uploads/small.gif"} {
+        if err := store.Put(path, []byte("GIF89a"), GifContentType); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := store.Copy("uploads/small.gif", "objects/copy.gif"); err != nil {
+        t.Fatal(err)
+    }
+    w, err := store.Writer("uploads/big.gif", GifContentType)
+    if err == nil {
+        _, err = w.Write(make([]byte, s3PartSize+1))
+    }
+    if err == nil {
+        err = w.Close()
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    want := map[string]string{
+        "/gifs/objects/small.gif": string(s3.PublicRead),
+        "/gifs/objects/copy.gif":  string(s3.PublicRead),
+        "/gifs/uploads/small.gif": string(s3.Private),
+        "/gifs/uploads/big.gif":   string(s3.Private),
+    }
+    shim.mu.Lock()
+    for path, acl := range want {
+        if shim.acls[path] != acl {
+            t.Errorf("%v was written with ACL %q, want %q", path, shim.acls[path], acl)
+        }
+    }
+    shim.mu.Unlock()
+
+    _, headers, err := store.SignedPutURL("uploads/direct.gif", GifContentType, time.Now().Add(time.Minute))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if headers["x-amz-acl"] != string(s3.Private) {
+        t.Errorf("direct uploads are signed with ACL %q, want %q", headers["x-amz-acl"], s3.Private)
+    }
+}
+
+// TestStreamPartReadError cuts a streamed upload off after its first part
+// has been sent, as a client going away would.
+func TestStreamPartReadError(t *testing.T) {
+    store, shim := testS3(t)
+    previous := blobs
+    t.Cleanup(func() { blobs = previous })
+    blobs = store
+
+    content := noiseGif(t, 1024, 8)
+    if len(content) < 2*s3PartSize || len(content) > uploadLimits.MaxBytes {
+        t.Fatalf("test gif is %v bytes, want between %v and %v", len(content), 2*s3PartSize, uploadLimits.MaxBytes)
+    }
+
+    var body bytes.Buffer
+    form := multipart.NewWriter(&body)
+    part, err := form.CreateFormFile("image", "big.gif")
+    if err == nil {
+        _, err = part.Write(content)
+    }
+    if err == nil {
+        err = form.Close()
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cut := body.Bytes()[:s3PartSize+s3PartSize/2]
+    reader := multipart.NewReader(io.MultiReader(bytes.NewReader(cut), iotest.ErrReader(errors.New("connection reset"))), form.Boundary())
+    filePart, err := reader.NextPart()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    upload, err := streamPart(filePart)
+    if err == nil {
+        upload.Discard()
+        t.Fatal("streamed an upload whose body failed part way")
+    }
+
+    if completed, aborted, open := shim.counts(); completed != 0 || aborted != 1 || open != 0 {
+        t.Errorf("got %v completed, %v aborted and %v open uploads, want 1 aborted", completed, aborted, open)
+    }
+    list, err := store.bucket.List(uploadsPrefix, "", "", 1000)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keys := make([]string, len(list.Contents))
+    for i, key := range list.Contents {
+        keys[i] = key.Key
+    }
+    if len(keys) > 0 {
+        t.Errorf("left %v behind", keys)
+    }
+}
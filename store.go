@@ -0,0 +1,129 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "time"
+)
+
+// GroupStore persists groups and the gifs that belong to them.
+type GroupStore interface {
+    // Status reports whether the store is reachable, for operators.
+    Status() StoreStatus
+
+    // NextGroupId and NextGifId atomically allocate a new, unused id. Ids
+    // are allocated before the record is written, so concurrent requests can
+    // never be handed the same id.
+    NextGroupId() (int, error)
+    NextGifId() (int, error)
+
+    // FindGroup returns a not found AppError for an unknown id.
+    FindGroup(id int) (*Group, error)
+    // FindAllGroups and FindGroupGifs return one page of the list, as
+    // selected by q.
+    FindAllGroups(q ListQuery) (Groups, Page, error)
+    FindGroupGifs(groupId int, q ListQuery) (Gifs, Page, error)
+    // FindGif returns a not found AppError for an unknown id. Found gifs
+    // come with their vote counts.
+    FindGif(id int) (*Gif, error)
+
+    SaveGroup(g *Group) error
+    SaveGif(gif *Gif) error
+
+    // MoveGif moves gif from its current group to groupId, updating
+    // gif.GroupId.
+    MoveGif(gif *Gif, groupId int) error
+
+    // DeleteGroup removes the group along with all of its gifs and members.
+    DeleteGroup(id int) error
+    DeleteGif(gif *Gif) error
+
+    // RetainObject and ReleaseObject count the records that share the
+    // content-addressed blob object stored under key. ReleaseObject returns
+    // how many references remain; at zero the object may be deleted, and is
+    // marked as deleting until ObjectDeleted is called or objectDeletingTTL
+    // passes.
+    RetainObject(key string) error
+    ReleaseObject(key string) (int, error)
+    ObjectDeleting(key string) (bool, error)
+    ObjectDeleted(key string) error
+
+    NextUserId() (int, error)
+    // FindUser returns a not found AppError for an unknown id.
+    FindUser(id int) (*User, error)
+    SaveUser(u *User) error
+
+    // FindApiKey returns a not found AppError for an unknown or revoked key.
+    FindApiKey(id string) (*ApiKey, error)
+    SaveApiKey(k *ApiKey) error
+    DeleteApiKey(id string) error
+
+    // VoteGif records the user's vote on the gif, replacing any earlier one:
+    // 1 for up, -1 for down, or 0 to withdraw it. It updates the gif's
+    // counts, and returns a not found AppError if the gif has been deleted.
+    VoteGif(gif *Gif, userId, vote int) error
+    // FindGroupLeaderboard returns the limit highest scoring gifs in the
+    // group, best first.
+    FindGroupLeaderboard(groupId, limit int) (Gifs, error)
+
+    // AddGroupMember, RemoveGroupMember and IsGroupMember manage the
+    // members of a group, apart from its owner, who always belongs to it.
+    // FindGroupMembers returns their user ids in ascending order.
+    AddGroupMember(groupId, userId int) error
+    RemoveGroupMember(groupId, userId int) error
+    IsGroupMember(groupId, userId int) (bool, error)
+    FindGroupMembers(groupId int) ([]int, error)
+
+    // SaveInvite keeps the invite until ttl passes.
+    SaveInvite(inv *Invite, ttl time.Duration) error
+    // FindInvite returns a not found AppError for an unknown, revoked or
+    // expired code.
+    FindInvite(code string) (*Invite, error)
+    DeleteInvite(code string) error
+
+    // RevokeToken denylists the session token with the given jti for ttl,
+    // which should last until the token expires. It reports whether this
+    // call revoked it, as opposed to an earlier one.
+    RevokeToken(jti string, ttl time.Duration) (bool, error)
+    IsTokenRevoked(jti string) (bool, error)
+
+    // SavePendingUpload keeps an issued direct upload until ttl passes.
+    SavePendingUpload(u *PendingUpload, ttl time.Duration) error
+    // FindPendingUpload returns a not found AppError for an unknown or
+    // expired upload.
+    FindPendingUpload(id string) (*PendingUpload, error)
+    // DeletePendingUpload reports whether it was the call that deleted the
+    // upload, so that only one of several concurrent completions goes ahead.
+    DeletePendingUpload(id string) (bool, error)
+}
+
+// Migrator is implemented by stores whose existing data may need upgrading to
+// the layout the current code expects. Migrate must be safe to run repeatedly.
+type Migrator interface {
+    Migrate() error
+}
+
+type StoreStatus struct {
+    Backend string     `json:"backend,omitempty"`
+    Healthy bool       `json:"healthy"`
+    Error   string     `json:"error,omitempty"`
+    Pool    *PoolStats `json:"pool,omitempty"`
+}
+
+type PoolStats struct {
+    ActiveCount int `json:"active_count"`
+    MaxIdle     int `json:"max_idle"`
+    MaxActive   int `json:"max_active"`
+}
+
+// NewGroupStore returns the store for the configured backend. An empty
+// backend defaults to Redis.
+func NewGroupStore(backend string) (GroupStore, error) {
+    switch backend {
+    case "", "redis":
+        return NewRedisStore(NewRedisPool(os.Getenv("REDIS_PORT"))), nil
+    case "memory":
+        return NewMemoryStore(), nil
+    }
+    return nil, fmt.Errorf("unknown store backend %q", backend)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+    "bytes"
+    "image"
+    "image/color"
+    "image/color/palette"
+    "image/draw"
+    "image/gif"
+    "image/png"
+)
+
+const PngContentType = "image/png"
+
+// previewMaxDimension bounds the width and height of animated previews.
+var previewMaxDimension = 200
+
+// Renditions are the smaller images generated from an uploaded GIF: a still
+// PNG poster of its first frame and an animated preview that fits within
+// previewMaxDimension. Preview is nil when the GIF already fits.
+type Renditions struct {
+    Poster  []byte
+    Preview []byte
+}
+
+// PosterPath and PreviewPath return where the renditions of the image at
+// imagePath are kept, next to the image itself.
+func PosterPath(imagePath string) string {
+    return imagePath + ".poster.png"
+}
+
+func PreviewPath(imagePath string) string {
+    return imagePath + ".preview.gif"
+}
+
+// MakeRenditions renders the poster and preview of decoded, scaling the
+// preview down a frame at a time as the animation is composed.
+func MakeRenditions(decoded *gif.GIF) (*Renditions, error) {
+    width, height := previewSize(decoded.Config.Width, decoded.Config.Height)
+    scaled := width != decoded.Config.Width || height != decoded.Config.Height
+
+    var poster bytes.Buffer
+    preview := &gif.GIF{Delay: decoded.Delay, LoopCount: decoded.LoopCount}
+    err := composeFrames(decoded, func(i int, canvas *image.RGBA) error {
+        if i == 0 {
+            if err := png.Encode(&poster, canvas); err != nil {
+                return err
+            }
+        }
+        if scaled {
+            // Every preview frame is a whole canvas, so each is cleared
+            // before the next rather than showing through it.
+            preview.Image = append(preview.Image, downscale(canvas, width, height))
+            preview.Disposal = append(preview.Disposal, gif.DisposalBackground)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if !scaled {
+        return &Renditions{Poster: poster.Bytes()}, nil
+    }
+
+    var encoded bytes.Buffer
+    err = gif.EncodeAll(&encoded, preview)
+    if err != nil {
+        return nil, err
+    }
+    return &Renditions{Poster: poster.Bytes(), Preview: encoded.Bytes()}, nil
+}
+
+// SaveRenditions generates and stores the renditions of the image kept at
+// imagePath.
+func SaveRenditions(imagePath string, decoded *gif.GIF) error {
+    renditions, err := MakeRenditions(decoded)
+    if err != nil {
+        return NewInternalError(ErrCodeInternal, "Error generating previews", err)
+    }
+
+    err = blobs.Put(PosterPath(imagePath), renditions.Poster, PngContentType)
+    if err != nil {
+        return err
+    }
+
+    if renditions.Preview == nil {
+        return blobs.Copy(imagePath, PreviewPath(imagePath))
+    }
+    return blobs.Put(PreviewPath(imagePath), renditions.Preview, GifContentType)
+}
+
+// composeFrames plays the animation onto a canvas the size of the GIF,
+// honouring each frame's disposal method, and calls fn with the canvas as it
+// stands after each frame. Frames in a GIF may only cover part of it. The one
+// canvas is drawn on throughout, so fn must copy anything it keeps.
+func composeFrames(decoded *gif.GIF, fn func(i int, canvas *image.RGBA) error) error {
+    bounds := image.Rect(0, 0, decoded.Config.Width, decoded.Config.Height)
+    canvas := image.NewRGBA(bounds)
+    var previous *image.RGBA
+
+    for i, frame := range decoded.Image {
+        disposal := byte(0)
+        if i < len(decoded.Disposal) {
+            disposal = decoded.Disposal[i]
+        }
+        if disposal == gif.DisposalPrevious {
+            if previous == nil {
+                previous = image.NewRGBA(bounds)
+            }
+            copy(previous.Pix, canvas.Pix)
+        }
+
+        draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+        if err := fn(i, canvas); err != nil {
+            return err
+        }
+
+        switch disposal {
+        case gif.DisposalBackground:
+            draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+        case gif.DisposalPrevious:
+            copy(canvas.Pix, previous.Pix)
+        }
+    }
+    return nil
+}
+
+// previewSize scales width and height down, keeping the aspect ratio, until
+// both fit within previewMaxDimension.
+func previewSize(width, height int) (int, int) {
+    if width <= previewMaxDimension && height <= previewMaxDimension {
+        return width, height
+    }
+    if width >= height {
+        return previewMaxDimension, atLeastOne(height * previewMaxDimension / width)
+    }
+    return atLeastOne(width * previewMaxDimension / height), previewMaxDimension
+}
+
+func atLeastOne(n int) int {
+    if n < 1 {
+        return 1
+    }
+    return n
+}
+
+// canvasPalette returns a palette for a composed frame, starting with a
+// transparent entry so that transparent areas of the canvas stay clear. The
+// canvas can hold colours from the palettes of several earlier frames; it
+// gets its own colours if there are few enough, and the web-safe colours
+// otherwise.
+func canvasPalette(img *image.RGBA) color.Palette {
+    colors := color.Palette{color.Transparent}
+    seen := make(map[color.RGBA]bool)
+    for i := 0; i < len(img.Pix); i += 4 {
+        c := color.RGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]}
+        if c.A == 0 || seen[c] {
+            continue
+        }
+        if len(colors) == 256 {
+            return append(color.Palette{color.Transparent}, palette.WebSafe...)
+        }
+        seen[c] = true
+        colors = append(colors, c)
+    }
+    return colors
+}
+
+// downscale resizes src to width by height with nearest neighbour sampling.
+func downscale(src *image.RGBA, width, height int) *image.Paletted {
+    bounds := src.Bounds()
+    scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            scaled.Set(x, y, src.At(x*bounds.Dx()/width, y*bounds.Dy()/height))
+        }
+    }
+
+    dst := image.NewPaletted(scaled.Bounds(), canvasPalette(scaled))
+    draw.Draw(dst, dst.Bounds(), scaled, image.ZP, draw.Src)
+    return dst
+}
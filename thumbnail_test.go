@@ -0,0 +1,76 @@
+package main
+
+import (
+    "bytes"
+    "image/gif"
+    "image/png"
+    "net/http"
+    "strconv"
+    "testing"
+)
+
+// uploadRenditions uploads a GIF larger than previews as a group's cover and
+// as a gif, and checks the poster and preview stored next to each.
+func uploadRenditions(t *testing.T, s GroupStore) {
+    e, apiKey := testServer(t, s)
+    content := animatedGif(t, 400, 200, 3, 200)
+
+    groupId, err := postForm(e, apiKey, "/api/v1/groups", map[string]string{"name": "group"}, content)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var group Group
+    getJSON(t, e, "", "/api/v1/groups/"+strconv.Itoa(groupId), &group)
+
+    path := "/api/v1/groups/" + strconv.Itoa(groupId) + "/gifs"
+    if _, err := postForm(e, apiKey, path, nil, content); err != nil {
+        t.Fatal(err)
+    }
+    var gifs Gifs
+    if code := getJSON(t, e, "", path, &gifs); code != http.StatusOK || len(gifs) != 1 {
+        t.Fatalf("got %v and %v gifs, want 1", code, len(gifs))
+    }
+
+    for name, urls := range map[string][3]string{
+        "group": {group.ImageKey, group.PosterUrl, group.PreviewUrl},
+        "gif":   {gifs[0].ImageKey, gifs[0].PosterUrl, gifs[0].PreviewUrl},
+    } {
+        key := urls[0]
+        if urls[1] != blobs.URL(PosterPath(key)) || urls[2] != blobs.URL(PreviewPath(key)) {
+            t.Errorf("%v has poster %q and preview %q, want them next to %v", name, urls[1], urls[2], key)
+            continue
+        }
+
+        stored, err := blobs.Get(PosterPath(key))
+        if err != nil {
+            t.Fatal(err)
+        }
+        poster, err := png.Decode(bytes.NewReader(stored))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if poster.Bounds().Dx() != 400 || poster.Bounds().Dy() != 200 {
+            t.Errorf("%v poster is %v, want 400x200", name, poster.Bounds())
+        }
+
+        stored, err = blobs.Get(PreviewPath(key))
+        if err != nil {
+            t.Fatal(err)
+        }
+        preview, err := gif.DecodeAll(bytes.NewReader(stored))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if preview.Config.Width != 200 || preview.Config.Height != 100 || len(preview.Image) != 3 {
+            t.Errorf("%v preview has %v frames of %vx%v, want 3 of 200x100", name, len(preview.Image), preview.Config.Width, preview.Config.Height)
+        }
+    }
+}
+
+func TestUploadRenditionsMemory(t *testing.T) {
+    uploadRenditions(t, NewMemoryStore())
+}
+
+func TestUploadRenditionsRedis(t *testing.T) {
+    uploadRenditions(t, testRedisStore(t))
+}
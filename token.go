@@ -0,0 +1,241 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    TokenAccess  = "access"
+    TokenRefresh = "refresh"
+)
+
+// SigningKey is one of the secrets tokens can be signed with, named by the
+// kid in the token header.
+type SigningKey struct {
+    Id     string
+    Secret []byte
+}
+
+// TokenOptions configures the session tokens issued by POST /auth/login.
+// Keys[0] signs new tokens; tokens signed by any of Keys are accepted, so a
+// new key can be put in front and the old one dropped once its tokens have
+// expired.
+type TokenOptions struct {
+    Keys       []SigningKey
+    AccessTTL  time.Duration
+    RefreshTTL time.Duration
+}
+
+var tokenOptions = TokenOptions{AccessTTL: 15 * time.Minute, RefreshTTL: 30 * 24 * time.Hour}
+
+// ParseSigningKeys parses a comma separated list of kid=secret pairs.
+func ParseSigningKeys(value string) ([]SigningKey, error) {
+    var keys []SigningKey
+    for _, pair := range strings.Split(value, ",") {
+        parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+        if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) < 32 {
+            return nil, errors.New("signing keys must be kid=secret pairs, with secrets of at least 32 characters")
+        }
+        keys = append(keys, SigningKey{Id: parts[0], Secret: []byte(parts[1])})
+    }
+    return keys, nil
+}
+
+// EphemeralSigningKey returns a random key for when none are configured.
+// Tokens signed with it stop working when the API restarts.
+func EphemeralSigningKey() (SigningKey, error) {
+    secret := make([]byte, 32)
+    _, err := rand.Read(secret)
+    return SigningKey{Id: "ephemeral", Secret: secret}, err
+}
+
+// TokenClaims is the payload of a session token.
+type TokenClaims struct {
+    Subject   string `json:"sub"` // the user id
+    Id        string `json:"jti"`
+    Use       string `json:"use"` // TokenAccess or TokenRefresh
+    IssuedAt  int64  `json:"iat"`
+    ExpiresAt int64  `json:"exp"`
+}
+
+type tokenHeader struct {
+    Algorithm string `json:"alg"`
+    Type      string `json:"typ"`
+    KeyId     string `json:"kid"`
+}
+
+// TokenPair is returned by login and refresh.
+type TokenPair struct {
+    AccessToken  string `json:"access_token"`
+    RefreshToken string `json:"refresh_token"`
+    TokenType    string `json:"token_type"`
+    ExpiresIn    int    `json:"expires_in"` // seconds until the access token expires
+    User         *User  `json:"user"`
+}
+
+// NewTokenPair issues a fresh access and refresh token for the user.
+func NewTokenPair(user *User) (*TokenPair, error) {
+    access, err := SignToken(user, TokenAccess, tokenOptions.AccessTTL)
+    if err != nil {
+        return nil, err
+    }
+    refresh, err := SignToken(user, TokenRefresh, tokenOptions.RefreshTTL)
+    if err != nil {
+        return nil, err
+    }
+
+    return &TokenPair{
+        AccessToken:  access,
+        RefreshToken: refresh,
+        TokenType:    "Bearer",
+        ExpiresIn:    int(tokenOptions.AccessTTL / time.Second),
+        User:         user,
+    }, nil
+}
+
+// SignToken returns an HS256 JWT for the user, signed with the first of
+// tokenOptions.Keys.
+func SignToken(user *User, use string, ttl time.Duration) (string, error) {
+    jti := make([]byte, 16)
+    if _, err := rand.Read(jti); err != nil {
+        return "", NewInternalError(ErrCodeInternal, "Error signing token", err)
+    }
+
+    now := time.Now()
+    key := tokenOptions.Keys[0]
+    header, err := json.Marshal(tokenHeader{Algorithm: "HS256", Type: "JWT", KeyId: key.Id})
+    if err != nil {
+        return "", NewInternalError(ErrCodeInternal, "Error signing token", err)
+    }
+    claims, err := json.Marshal(TokenClaims{
+        Subject:   strconv.Itoa(user.Id),
+        Id:        hex.EncodeToString(jti),
+        Use:       use,
+        IssuedAt:  now.Unix(),
+        ExpiresAt: now.Add(ttl).Unix(),
+    })
+    if err != nil {
+        return "", NewInternalError(ErrCodeInternal, "Error signing token", err)
+    }
+
+    signed := encodeSegment(header) + "." + encodeSegment(claims)
+    return signed + "." + encodeSegment(signToken(key, signed)), nil
+}
+
+// VerifyToken checks the token's signature, expiry and use, and that it has
+// not been revoked, and returns its claims. Any problem with the token
+// itself is an unauthorized AppError.
+func VerifyToken(token, use string) (*TokenClaims, error) {
+    claims, err := parseToken(token, use)
+    if err != nil {
+        return nil, NewAppError(http.StatusUnauthorized, ErrCodeUnauthorized, "Invalid or expired token", err)
+    }
+
+    revoked, err := store.IsTokenRevoked(claims.Id)
+    if err != nil {
+        return nil, err
+    }
+    if revoked {
+        return nil, NewAppError(http.StatusUnauthorized, ErrCodeUnauthorized, "Token has been revoked", nil)
+    }
+    return claims, nil
+}
+
+func parseToken(token, use string) (*TokenClaims, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, errors.New("malformed token")
+    }
+
+    var header tokenHeader
+    if err := decodeSegment(parts[0], &header); err != nil {
+        return nil, err
+    }
+    if header.Algorithm != "HS256" { // never "none", or another key type
+        return nil, fmt.Errorf("unexpected algorithm %q", header.Algorithm)
+    }
+
+    key, ok := findSigningKey(header.KeyId)
+    if !ok {
+        return nil, fmt.Errorf("unknown key %q", header.KeyId)
+    }
+    signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil || !hmac.Equal(signature, signToken(key, parts[0]+"."+parts[1])) {
+        return nil, errors.New("bad signature")
+    }
+
+    var claims TokenClaims
+    if err := decodeSegment(parts[1], &claims); err != nil {
+        return nil, err
+    }
+    if time.Now().Unix() >= claims.ExpiresAt {
+        return nil, errors.New("token has expired")
+    }
+    if claims.Use != use {
+        return nil, fmt.Errorf("not an %v token", use)
+    }
+    return &claims, nil
+}
+
+// RevokeToken denylists the token until it would have expired anyway, and
+// reports whether this call revoked it. A token that has expired already is
+// left alone, and reported as not revoked.
+func RevokeToken(claims *TokenClaims) (bool, error) {
+    ttl := time.Until(time.Unix(claims.ExpiresAt, 0))
+    if ttl <= 0 {
+        return false, nil
+    }
+    return store.RevokeToken(claims.Id, ttl)
+}
+
+// FindTokenUser returns the user the token was issued to.
+func FindTokenUser(claims *TokenClaims) (*User, error) {
+    id, err := strconv.Atoi(claims.Subject)
+    if err != nil {
+        return nil, NewAppError(http.StatusUnauthorized, ErrCodeUnauthorized, "Invalid or expired token", err)
+    }
+
+    user, err := store.FindUser(id)
+    if appErr, ok := err.(*AppError); ok && appErr.Code == ErrCodeNotFound {
+        return nil, NewAppError(http.StatusUnauthorized, ErrCodeUnauthorized, "Invalid or expired token", err)
+    }
+    return user, err
+}
+
+func findSigningKey(id string) (SigningKey, bool) {
+    for _, key := range tokenOptions.Keys {
+        if key.Id == id {
+            return key, true
+        }
+    }
+    return SigningKey{}, false
+}
+
+func signToken(key SigningKey, signed string) []byte {
+    mac := hmac.New(sha256.New, key.Secret)
+    mac.Write([]byte(signed))
+    return mac.Sum(nil)
+}
+
+func encodeSegment(b []byte) string {
+    return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+    b, err := base64.RawURLEncoding.DecodeString(segment)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(b, v)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "net/http"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/labstack/echo"
+)
+
+// revokeOnce revokes one token many times at once, and checks that only one
+// of the calls reports revoking it, as only that refresh may get new tokens.
+func revokeOnce(t *testing.T, s GroupStore) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        t.Fatal(err)
+    }
+    jti := hex.EncodeToString(b)
+
+    const n = 20
+    var wg sync.WaitGroup
+    results := make(chan bool, n)
+    for i := 0; i < n; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            revoked, err := s.RevokeToken(jti, time.Minute)
+            if err != nil {
+                t.Error(err)
+            }
+            results <- revoked
+        }()
+    }
+    wg.Wait()
+    close(results)
+
+    count := 0
+    for revoked := range results {
+        if revoked {
+            count++
+        }
+    }
+    if count != 1 {
+        t.Errorf("%v calls revoked the token, want 1", count)
+    }
+
+    revoked, err := s.IsTokenRevoked(jti)
+    if err != nil || !revoked {
+        t.Errorf("token revoked %v, error %v", revoked, err)
+    }
+}
+
+func TestRevokeTokenOnceMemory(t *testing.T) {
+    revokeOnce(t, NewMemoryStore())
+}
+
+func TestRevokeTokenOnceRedis(t *testing.T) {
+    revokeOnce(t, testRedisStore(t))
+}
+
+// getMe fetches the user an access token belongs to, as serve does.
+func getMe(t *testing.T, e *echo.Echo, accessToken string) int {
+    req, err := http.NewRequest("GET", "/api/v1/users/me", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("Authorization", "Bearer "+accessToken)
+    return serve(t, e, req, "", nil)
+}
+
+// rotateTokens logs in, refreshes and logs out, and checks that a refresh
+// token only works once, that tokens outlive the rotation of their signing
+// key until it is dropped, and that logging out revokes both tokens.
+func rotateTokens(t *testing.T, s GroupStore) {
+    e, apiKey := testServer(t, s)
+    previous := tokenOptions.Keys
+    t.Cleanup(func() { tokenOptions.Keys = previous })
+    old, err := EphemeralSigningKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    tokenOptions.Keys = []SigningKey{old}
+
+    var first TokenPair
+    if code := sendForm(t, e, "POST", apiKey, "/api/v1/auth/login", nil, nil, &first); code != http.StatusOK {
+        t.Fatalf("logging in got %v", code)
+    }
+    if code := getMe(t, e, first.AccessToken); code != http.StatusOK {
+        t.Errorf("access token got %v", code)
+    }
+
+    var second TokenPair
+    refresh := map[string]string{"refresh_token": first.RefreshToken}
+    if code := sendForm(t, e, "POST", "", "/api/v1/auth/refresh", refresh, nil, &second); code != http.StatusOK {
+        t.Fatalf("refreshing got %v", code)
+    }
+    if code := sendForm(t, e, "POST", "", "/api/v1/auth/refresh", refresh, nil, nil); code != http.StatusUnauthorized {
+        t.Errorf("refreshing twice got %v, want %v", code, http.StatusUnauthorized)
+    }
+
+    key, err := EphemeralSigningKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    key.Id = "new"
+    tokenOptions.Keys = []SigningKey{key, old}
+    if code := getMe(t, e, second.AccessToken); code != http.StatusOK {
+        t.Errorf("access token signed by the old key got %v", code)
+    }
+    tokenOptions.Keys = []SigningKey{key}
+    if code := getMe(t, e, second.AccessToken); code != http.StatusUnauthorized {
+        t.Errorf("access token signed by a dropped key got %v, want %v", code, http.StatusUnauthorized)
+    }
+
+    var third TokenPair
+    if code := sendForm(t, e, "POST", apiKey, "/api/v1/auth/login", nil, nil, &third); code != http.StatusOK {
+        t.Fatalf("logging in got %v", code)
+    }
+    req, err := http.NewRequest("POST", "/api/v1/auth/logout?refresh_token="+third.RefreshToken, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("Authorization", "Bearer "+third.AccessToken)
+    if code := serve(t, e, req, "", nil); code != http.StatusOK {
+        t.Fatalf("logging out got %v", code)
+    }
+    if code := getMe(t, e, third.AccessToken); code != http.StatusUnauthorized {
+        t.Errorf("access token after logging out got %v, want %v", code, http.StatusUnauthorized)
+    }
+    refresh = map[string]string{"refresh_token": third.RefreshToken}
+    if code := sendForm(t, e, "POST", "", "/api/v1/auth/refresh", refresh, nil, nil); code != http.StatusUnauthorized {
+        t.Errorf("refreshing after logging out got %v, want %v", code, http.StatusUnauthorized)
+    }
+}
+
+func TestRotateTokensMemory(t *testing.T) {
+    rotateTokens(t, NewMemoryStore())
+}
+
+func TestRotateTokensRedis(t *testing.T) {
+    rotateTokens(t, testRedisStore(t))
+}
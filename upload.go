@@ -0,0 +1,398 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "hash"
+    "image/gif"
+    "io"
+    "io/ioutil"
+    "mime/multipart"
+    "net/http"
+    "net/url"
+)
+
+const GifContentType = "image/gif"
+
+// maxFormValueBytes bounds each ordinary field of a streamed multipart form.
+const maxFormValueBytes = 64 << 10
+
+// UploadLimits bounds the images accepted by StreamUpload and NewUpload.
+// MaxFrames and MaxPixels bound the decoded animation, which can be far
+// larger than the file: MaxPixels caps the area of all its frames together.
+type UploadLimits struct {
+    MaxBytes     int
+    MaxDimension int
+    MaxFrames    int
+    MaxPixels    int
+}
+
+var uploadLimits = UploadLimits{MaxBytes: 16 << 20, MaxDimension: 2048, MaxFrames: 1000, MaxPixels: 100 << 20}
+
+// Upload is a GIF that has passed validation and is ready to be stored. Its
+// file is either held in memory, or was streamed to a temporary path in blob
+// storage to keep large uploads out of memory.
+type Upload struct {
+    Filename string
+    Decoded  *gif.GIF
+    Size     int
+    Sha256   string
+
+    content  []byte
+    tempPath string
+}
+
+// NewUpload validates content, e.g. a file read from an archive, as a GIF.
+func NewUpload(content []byte, filename string) (*Upload, error) {
+    decoded, err := DecodeGif(content)
+    if err != nil {
+        return nil, err
+    }
+    return &Upload{
+        Filename: filename,
+        Decoded:  decoded,
+        Size:     len(content),
+        Sha256:   ContentHash(content),
+        content:  content,
+    }, nil
+}
+
+// StreamUpload reads a multipart form without buffering its files. The file
+// in the named field is validated and decoded as it streams to temporary
+// blob storage, so the file itself is never held in memory whole; its
+// decoded frames are, within uploadLimits.MaxFrames and MaxPixels.
+// Other fields are kept in req.Form, and must be read after calling this.
+// It returns nil, and no error, when there is no such file. The caller must
+// Discard the upload once done with it.
+func StreamUpload(req *http.Request, field string) (*Upload, error) {
+    reader, err := req.MultipartReader()
+    if err == http.ErrNotMultipart { // e.g. a url encoded form, without files
+        req.ParseForm()
+        return nil, nil
+    }
+    if err != nil {
+        return nil, NewBadRequestError(ErrCodeInvalidForm, "Invalid form", err)
+    }
+
+    req.Form, req.PostForm = url.Values{}, url.Values{}
+    var upload *Upload
+    for {
+        part, err := reader.NextPart()
+        if err == io.EOF {
+            return upload, nil
+        }
+        if err != nil {
+            upload.Discard()
+            return nil, NewBadRequestError(ErrCodeInvalidForm, "Invalid form", err)
+        }
+
+        if part.FormName() == field && len(part.FileName()) > 0 && upload == nil {
+            upload, err = streamPart(part)
+            if err != nil {
+                return nil, err
+            }
+            continue
+        }
+
+        value, err := ioutil.ReadAll(io.LimitReader(part, maxFormValueBytes))
+        if err != nil {
+            upload.Discard()
+            return nil, NewBadRequestError(ErrCodeInvalidForm, "Invalid form", err)
+        }
+        req.Form.Add(part.FormName(), string(value))
+        req.PostForm.Add(part.FormName(), string(value))
+    }
+}
+
+// streamPart stores the part at a temporary path while decoding it. If the
+// client goes away, reading the part fails and whatever was stored so far is
+// aborted.
+func streamPart(part *multipart.Part) (*Upload, error) {
+    upload, err := storeTemp(part)
+    if err != nil {
+        return nil, err
+    }
+    upload.Filename = part.FileName()
+    return upload, nil
+}
+
+// storeTemp decodes the GIF read from r as it stores it at a new temporary
+// path, which the caller must Discard.
+func storeTemp(r io.Reader) (*Upload, error) {
+    tempPath, err := tempUploadPath()
+    if err != nil {
+        return nil, NewInternalError(ErrCodeInternal, "Error starting upload", err)
+    }
+
+    w, err := blobs.Writer(tempPath, GifContentType)
+    if err != nil {
+        return nil, err
+    }
+
+    upload, err := decodeStream(r, w)
+    if err == nil {
+        err = w.Close()
+    }
+    if err != nil {
+        w.Abort()
+        return nil, err
+    }
+
+    upload.tempPath = tempPath
+    return upload, nil
+}
+
+// decodeStream decodes the GIF read from r, copying every byte read to w
+// and hashing it on the way.
+func decodeStream(r io.Reader, w io.Writer) (*Upload, error) {
+    sum := sha256.New()
+    counter := &byteCounter{}
+    limiter := newFrameLimiter()
+    tee := io.TeeReader(io.LimitReader(r, int64(uploadLimits.MaxBytes)+1), io.MultiWriter(w, sum, counter, limiter))
+    body := bufio.NewReader(tee)
+
+    header, _ := body.Peek(10)
+    err := checkGifHeader(header)
+    if err != nil {
+        return nil, err
+    }
+
+    decoded, err := gif.DecodeAll(body)
+    if err == nil {
+        _, err = io.Copy(ioutil.Discard, body) // anything after the trailer
+    }
+    if counter.n > uploadLimits.MaxBytes {
+        return nil, tooLargeError()
+    }
+    if limiter.err != nil {
+        return nil, limiter.err
+    }
+    if err != nil {
+        return nil, NewBadRequestError(ErrCodeInvalidGif, "GIF is corrupt", err)
+    }
+
+    return &Upload{Decoded: decoded, Size: counter.n, Sha256: hashString(sum)}, nil
+}
+
+// store writes the upload's file to key.
+func (u *Upload) store(key string) error {
+    if u.content != nil {
+        return blobs.Put(key, u.content, GifContentType)
+    }
+    return blobs.Copy(u.tempPath, key)
+}
+
+// Discard removes the temporary copy of a streamed upload. It is safe to
+// call on nil.
+func (u *Upload) Discard() error {
+    if u == nil || len(u.tempPath) == 0 {
+        return nil
+    }
+    return blobs.Delete(u.tempPath)
+}
+
+func tempUploadPath() (string, error) {
+    b := make([]byte, 16)
+    _, err := rand.Read(b)
+    return uploadsPrefix + hex.EncodeToString(b) + ".gif", err
+}
+
+type byteCounter struct {
+    n int
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+    c.n += len(p)
+    return len(p), nil
+}
+
+func tooLargeError() error {
+    return NewAppError(http.StatusRequestEntityTooLarge, ErrCodeTooLarge,
+        fmt.Sprintf("Image is larger than %v bytes", uploadLimits.MaxBytes), nil)
+}
+
+// checkGifHeader checks that header, the first 10 bytes of a file, starts a
+// GIF, judged by its magic bytes rather than anything the client claims,
+// and that the GIF is within uploadLimits.MaxDimension.
+func checkGifHeader(header []byte) error {
+    if len(header) < 10 || http.DetectContentType(header) != GifContentType {
+        return NewAppError(http.StatusUnsupportedMediaType, ErrCodeNotGif, "Image is not a GIF", nil)
+    }
+
+    width := int(binary.LittleEndian.Uint16(header[6:8]))
+    height := int(binary.LittleEndian.Uint16(header[8:10]))
+    if width > uploadLimits.MaxDimension || height > uploadLimits.MaxDimension {
+        return NewBadRequestError(ErrCodeInvalidGif,
+            fmt.Sprintf("GIF is larger than %vx%v pixels", uploadLimits.MaxDimension, uploadLimits.MaxDimension), nil)
+    }
+    return nil
+}
+
+// frameLimiter follows the block structure of a GIF written to it, without
+// decoding any image data, and fails once the GIF has more frames or pixels
+// than uploadLimits allows. Placed in front of the decoder, it stops a small
+// file that describes an enormous animation before the frames are allocated.
+type frameLimiter struct {
+    frames int
+    pixels int
+    err    error // why the GIF was refused
+
+    field []byte             // what has been read of the next field
+    want  int                // the length of the next field
+    skip  int                // how many bytes to pass over before it
+    next  func([]byte) error // handles the next field once it is read
+    done  bool               // the image data has all been read
+}
+
+func newFrameLimiter() *frameLimiter {
+    l := &frameLimiter{}
+    l.expect(13, l.screen) // the header and logical screen descriptor
+    return l
+}
+
+func (l *frameLimiter) Write(p []byte) (int, error) {
+    written := len(p)
+    for len(p) > 0 && !l.done && l.err == nil {
+        if l.skip > 0 {
+            n := l.skip
+            if n > len(p) {
+                n = len(p)
+            }
+            l.skip -= n
+            p = p[n:]
+            continue
+        }
+
+        n := l.want - len(l.field)
+        if n > len(p) {
+            n = len(p)
+        }
+        l.field = append(l.field, p[:n]...)
+        p = p[n:]
+        if len(l.field) == l.want {
+            l.err = l.next(l.field)
+        }
+    }
+    return written, l.err
+}
+
+func (l *frameLimiter) expect(n int, next func([]byte) error) {
+    l.field, l.want, l.next = l.field[:0], n, next
+}
+
+// skipColorTable passes over the color table that flags, the packed field
+// of a descriptor, says follows it.
+func (l *frameLimiter) skipColorTable(flags byte) {
+    if flags&0x80 != 0 {
+        l.skip += 3 << (flags&0x07 + 1)
+    }
+}
+
+func (l *frameLimiter) screen(b []byte) error {
+    l.skipColorTable(b[10])
+    l.expect(1, l.block)
+    return nil
+}
+
+func (l *frameLimiter) block(b []byte) error {
+    switch b[0] {
+    case 0x21: // extension, followed by its label
+        l.expect(1, l.subBlocks)
+        l.skip++
+    case 0x2C: // image descriptor
+        l.expect(9, l.image)
+    default: // the trailer, or a malformed block left for the decoder to report
+        l.done = true
+    }
+    return nil
+}
+
+func (l *frameLimiter) image(b []byte) error {
+    l.frames++
+    l.pixels += int(binary.LittleEndian.Uint16(b[4:6])) * int(binary.LittleEndian.Uint16(b[6:8]))
+    if l.frames > uploadLimits.MaxFrames {
+        return NewBadRequestError(ErrCodeInvalidGif, fmt.Sprintf("GIF has more than %v frames", uploadLimits.MaxFrames), nil)
+    }
+    if l.pixels > uploadLimits.MaxPixels {
+        return NewBadRequestError(ErrCodeInvalidGif,
+            fmt.Sprintf("GIF has more than %v pixels across its frames", uploadLimits.MaxPixels), nil)
+    }
+
+    l.skipColorTable(b[8])
+    l.skip++ // the LZW minimum code size
+    l.expect(1, l.subBlocks)
+    return nil
+}
+
+// subBlocks reads the size of the next data sub-block, passing over its
+// data, until the empty block that ends them.
+func (l *frameLimiter) subBlocks(b []byte) error {
+    if b[0] == 0 {
+        l.expect(1, l.block)
+        return nil
+    }
+    l.skip += int(b[0])
+    l.expect(1, l.subBlocks)
+    return nil
+}
+
+// DecodeGif checks that content is a GIF within uploadLimits, and that it
+// decodes cleanly.
+func DecodeGif(content []byte) (*gif.GIF, error) {
+    if len(content) > uploadLimits.MaxBytes {
+        return nil, tooLargeError()
+    }
+
+    header := content
+    if len(header) > 10 {
+        header = header[:10]
+    }
+    err := checkGifHeader(header)
+    if err != nil {
+        return nil, err
+    }
+    _, err = newFrameLimiter().Write(content)
+    if err != nil {
+        return nil, err
+    }
+
+    decoded, err := gif.DecodeAll(bytes.NewReader(content))
+    if err != nil {
+        return nil, NewBadRequestError(ErrCodeInvalidGif, "GIF is corrupt", err)
+    }
+    return decoded, nil
+}
+
+// SetGifMetadata records what clients need to lay out g without downloading
+// it: its dimensions, animation details, size and content hash.
+func SetGifMetadata(g *Gif, u *Upload) {
+    g.Width = u.Decoded.Config.Width
+    g.Height = u.Decoded.Config.Height
+    g.Frames = len(u.Decoded.Image)
+    g.LoopCount = u.Decoded.LoopCount
+    g.Size = u.Size
+
+    g.DurationMs = 0
+    for _, delay := range u.Decoded.Delay {
+        g.DurationMs += delay * 10 // delays are in hundredths of a second
+    }
+
+    g.Sha256 = u.Sha256
+    g.PHash = PerceptualHash(u.Decoded)
+}
+
+// ContentHash returns the hex SHA-256 of content.
+func ContentHash(content []byte) string {
+    sum := sha256.New()
+    sum.Write(content)
+    return hashString(sum)
+}
+
+func hashString(h hash.Hash) string {
+    return hex.EncodeToString(h.Sum(nil))
+}
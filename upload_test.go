@@ -0,0 +1,107 @@
+package main
+
+import (
+    "bytes"
+    "image"
+    "image/color"
+    "image/gif"
+    "io/ioutil"
+    "net/http"
+    "strconv"
+    "testing"
+)
+
+// animatedGif encodes a width by height GIF of frames frames, each size
+// pixels square.
+func animatedGif(t *testing.T, width, height, frames, size int) []byte {
+    palette := color.Palette{color.Black, color.White}
+    g := &gif.GIF{Config: image.Config{Width: width, Height: height, ColorModel: palette}}
+    for i := 0; i < frames; i++ {
+        g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, size, size), palette))
+        g.Delay = append(g.Delay, 10)
+    }
+
+    var b bytes.Buffer
+    if err := gif.EncodeAll(&b, g); err != nil {
+        t.Fatal(err)
+    }
+    return b.Bytes()
+}
+
+func TestFrameLimits(t *testing.T) {
+    previous := uploadLimits
+    defer func() { uploadLimits = previous }()
+    uploadLimits.MaxFrames = 10
+    uploadLimits.MaxPixels = 1000
+
+    tests := []struct {
+        name    string
+        content []byte
+        ok      bool
+    }{
+        {"within limits", animatedGif(t, 20, 20, 10, 10), true},
+        {"too many frames", animatedGif(t, 20, 20, 11, 1), false},
+        {"too many pixels", animatedGif(t, 20, 20, 3, 20), false},
+    }
+
+    for _, test := range tests {
+        _, err := DecodeGif(test.content)
+        if (err == nil) != test.ok {
+            t.Errorf("DecodeGif %v: got error %v", test.name, err)
+        }
+
+        _, err = decodeStream(bytes.NewReader(test.content), ioutil.Discard)
+        if (err == nil) != test.ok {
+            t.Errorf("decodeStream %v: got error %v", test.name, err)
+        }
+        if appErr, ok := err.(*AppError); err != nil && (!ok || appErr.Code != ErrCodeInvalidGif) {
+            t.Errorf("decodeStream %v: got error %v, want an invalid GIF error", test.name, err)
+        }
+    }
+}
+
+// gifMetadata uploads an animated gif, and checks the metadata its group's
+// gifs are listed with.
+func gifMetadata(t *testing.T, s GroupStore) {
+    e, apiKey := testServer(t, s)
+    groupId, err := postForm(e, apiKey, "/api/v1/groups", map[string]string{"name": "group"}, testGif(t, color.White))
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := "/api/v1/groups/" + strconv.Itoa(groupId) + "/gifs"
+
+    // Play it three times in all, rather than forever as by default.
+    g, err := gif.DecodeAll(bytes.NewReader(animatedGif(t, 20, 10, 3, 10)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    g.LoopCount = 2
+    var b bytes.Buffer
+    if err := gif.EncodeAll(&b, g); err != nil {
+        t.Fatal(err)
+    }
+    content := b.Bytes()
+
+    if _, err := postForm(e, apiKey, path, nil, content); err != nil {
+        t.Fatal(err)
+    }
+
+    var gifs Gifs
+    if code := getJSON(t, e, "", path, &gifs); code != http.StatusOK || len(gifs) != 1 {
+        t.Fatalf("got %v and %v gifs, want 1", code, len(gifs))
+    }
+    got := gifs[0]
+    want := Gif{Width: 20, Height: 10, Frames: 3, DurationMs: 300, LoopCount: 2, Size: len(content), Sha256: ContentHash(content)}
+    if got.Width != want.Width || got.Height != want.Height || got.Frames != want.Frames || got.DurationMs != want.DurationMs ||
+        got.LoopCount != want.LoopCount || got.Size != want.Size || got.Sha256 != want.Sha256 {
+        t.Errorf("got metadata %+v, want %+v", got, want)
+    }
+}
+
+func TestGifMetadataMemory(t *testing.T) {
+    gifMetadata(t, NewMemoryStore())
+}
+
+func TestGifMetadataRedis(t *testing.T) {
+    gifMetadata(t, testRedisStore(t))
+}
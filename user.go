@@ -0,0 +1,162 @@
+package main
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/hex"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/labstack/echo"
+)
+
+// ApiKeyHeader is the request header clients send their API key in.
+const ApiKeyHeader = "X-Api-Key"
+
+// userContextKey and claimsContextKey are where Authenticate keeps the
+// authenticated user, and the claims of the session token they sent if any,
+// on the request context.
+const (
+    userContextKey   = "user"
+    claimsContextKey = "claims"
+)
+
+// publicRoutes are the mutating routes that are called without
+// authenticating, e.g. to register in the first place. Credentials sent to
+// them are ignored, such as a client's expired access token when it
+// refreshes.
+var publicRoutes = map[string]bool{
+    "POST /api/v1/users":        true,
+    "POST /api/v1/auth/refresh": true,
+}
+
+type User struct {
+    Id        int       `json:"id"`
+    Name      string    `json:"name"`
+    Role      string    `json:"role"` // RolePlayer, RoleModerator or RoleAdmin
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// ApiKey is the stored half of an API key. Clients hold the key itself,
+// "{id}.{secret}"; only a hash of the secret is kept, so the store can't
+// leak working keys. Secrets are 32 random bytes, too many to brute force,
+// which is why a plain SHA-256 is enough.
+type ApiKey struct {
+    Id         string    `json:"id"`
+    UserId     int       `json:"user_id"`
+    SecretHash string    `json:"secret_hash"`
+    CreatedAt  time.Time `json:"created_at"`
+}
+
+// IssuedKey is returned once, when an API key is made. The key can't be
+// recovered afterwards.
+type IssuedKey struct {
+    Id     string `json:"id"`
+    ApiKey string `json:"api_key"`
+    User   *User  `json:"user"`
+}
+
+// NewApiKey makes a key for the user and saves its hash.
+func NewApiKey(user *User) (*IssuedKey, error) {
+    id, secret := make([]byte, 8), make([]byte, 32)
+    _, err := rand.Read(id)
+    if err == nil {
+        _, err = rand.Read(secret)
+    }
+    if err != nil {
+        return nil, NewInternalError(ErrCodeInternal, "Error making API key", err)
+    }
+
+    key := &ApiKey{
+        Id:         hex.EncodeToString(id),
+        UserId:     user.Id,
+        SecretHash: ContentHash([]byte(hex.EncodeToString(secret))),
+        CreatedAt:  time.Now().UTC(),
+    }
+    err = store.SaveApiKey(key)
+    if err != nil {
+        return nil, err
+    }
+
+    return &IssuedKey{Id: key.Id, ApiKey: key.Id + "." + hex.EncodeToString(secret), User: user}, nil
+}
+
+// FindApiKeyUser returns the owner of apiKey, or an unauthorized AppError if
+// the key is malformed, revoked or wrong.
+func FindApiKeyUser(apiKey string) (*User, error) {
+    invalid := NewAppError(http.StatusUnauthorized, ErrCodeUnauthorized, "Invalid API key", nil)
+
+    parts := strings.SplitN(apiKey, ".", 2)
+    if len(parts) != 2 {
+        return nil, invalid
+    }
+
+    key, err := store.FindApiKey(parts[0])
+    if appErr, ok := err.(*AppError); ok && appErr.Code == ErrCodeNotFound {
+        return nil, invalid
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    hash := ContentHash([]byte(parts[1]))
+    if subtle.ConstantTimeCompare([]byte(hash), []byte(key.SecretHash)) != 1 {
+        return nil, invalid
+    }
+    return store.FindUser(key.UserId)
+}
+
+// Authenticate is middleware that identifies the user making the request from
+// their API key, or the access token sent as an Authorization bearer token.
+// Reads may be made anonymously, but any other request must be authenticated
+// unless it is one of publicRoutes.
+func Authenticate(c *echo.Context) error {
+    req := c.Request()
+    if publicRoutes[req.Method+" "+strings.TrimSuffix(req.URL.Path, "/")] {
+        return nil
+    }
+
+    if apiKey := req.Header.Get(ApiKeyHeader); len(apiKey) > 0 {
+        user, err := FindApiKeyUser(apiKey)
+        if err != nil {
+            return err
+        }
+        c.Set(userContextKey, user)
+        return nil
+    }
+
+    if auth := req.Header.Get("Authorization"); len(auth) > 0 {
+        if !strings.HasPrefix(auth, "Bearer ") {
+            return NewAppError(http.StatusUnauthorized, ErrCodeUnauthorized, "Invalid or expired token", nil)
+        }
+        claims, err := VerifyToken(strings.TrimPrefix(auth, "Bearer "), TokenAccess)
+        if err != nil {
+            return err
+        }
+        user, err := FindTokenUser(claims)
+        if err != nil {
+            return err
+        }
+        c.Set(userContextKey, user)
+        c.Set(claimsContextKey, claims)
+        return nil
+    }
+
+    switch req.Method {
+    case "GET", "HEAD", "OPTIONS":
+        return nil
+    }
+    return NewAppError(http.StatusUnauthorized, ErrCodeUnauthorized, "Authentication required", nil)
+}
+
+// CurrentUser returns the user Authenticate identified, or an unauthorized
+// AppError for anonymous requests. Use RequestUser where anonymous requests
+// are allowed.
+func CurrentUser(c *echo.Context) (*User, error) {
+    user, ok := c.Get(userContextKey).(*User)
+    if !ok {
+        return nil, NewAppError(http.StatusUnauthorized, ErrCodeUnauthorized, "Authentication required", nil)
+    }
+    return user, nil
+}
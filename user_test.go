@@ -0,0 +1,55 @@
+package main
+
+import (
+    "net/http"
+    "testing"
+)
+
+// apiKeys registers a user, makes them a second API key and revokes the
+// first, and checks that the revoked key stops working while the other
+// carries on, and that no one else can revoke it.
+func apiKeys(t *testing.T, s GroupStore) {
+    e, otherKey := testServer(t, s)
+
+    var first IssuedKey
+    if code := sendForm(t, e, "POST", "", "/api/v1/users", map[string]string{"name": " alice "}, nil, &first); code != http.StatusOK {
+        t.Fatalf("registering got %v", code)
+    }
+    var user User
+    if code := getJSON(t, e, first.ApiKey, "/api/v1/users/me", &user); code != http.StatusOK || user.Name != "alice" || user.Role != RolePlayer {
+        t.Errorf("got %v and user %q with role %q, want alice the player", code, user.Name, user.Role)
+    }
+    if code := sendForm(t, e, "POST", "", "/api/v1/users", map[string]string{"name": " "}, nil, nil); code != http.StatusBadRequest {
+        t.Errorf("registering without a name got %v, want %v", code, http.StatusBadRequest)
+    }
+
+    var second IssuedKey
+    if code := sendForm(t, e, "POST", first.ApiKey, "/api/v1/users/me/keys", nil, nil, &second); code != http.StatusOK {
+        t.Fatalf("making a key got %v", code)
+    }
+    path := "/api/v1/users/me/keys/" + first.Id
+    if code := sendForm(t, e, "DELETE", otherKey, path, nil, nil, nil); code != http.StatusNotFound {
+        t.Errorf("revoking someone else's key got %v, want %v", code, http.StatusNotFound)
+    }
+    if code := sendForm(t, e, "DELETE", second.ApiKey, path, nil, nil, nil); code != http.StatusOK {
+        t.Fatalf("revoking got %v", code)
+    }
+
+    if code := getJSON(t, e, first.ApiKey, "/api/v1/users/me", nil); code != http.StatusUnauthorized {
+        t.Errorf("revoked key got %v, want %v", code, http.StatusUnauthorized)
+    }
+    if code := getJSON(t, e, second.ApiKey, "/api/v1/users/me", &user); code != http.StatusOK || user.Name != "alice" {
+        t.Errorf("remaining key got %v and user %q, want alice", code, user.Name)
+    }
+    if code := getJSON(t, e, "", "/api/v1/users/me", nil); code != http.StatusUnauthorized {
+        t.Errorf("anonymous got %v, want %v", code, http.StatusUnauthorized)
+    }
+}
+
+func TestApiKeysMemory(t *testing.T) {
+    apiKeys(t, NewMemoryStore())
+}
+
+func TestApiKeysRedis(t *testing.T) {
+    apiKeys(t, testRedisStore(t))
+}
@@ -0,0 +1,27 @@
+package main
+
+const (
+    VoteUp   = "up"
+    VoteDown = "down"
+
+    // DefaultLeaderboardLimit is how many gifs a leaderboard holds unless
+    // ?limit= says otherwise.
+    DefaultLeaderboardLimit = 10
+)
+
+// ParseVote converts the vote form field into the value recorded for the
+// user: 1 for VoteUp and -1 for VoteDown.
+func ParseVote(vote string) (int, error) {
+    switch vote {
+    case VoteUp:
+        return 1, nil
+    case VoteDown:
+        return -1, nil
+    }
+    return 0, NewBadRequestError(ErrCodeInvalidForm, "vote must be up or down", nil)
+}
+
+// GifScore ranks gifs on their group's leaderboard.
+func GifScore(gif *Gif) int {
+    return gif.Upvotes - gif.Downvotes
+}
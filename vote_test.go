@@ -0,0 +1,161 @@
+package main
+
+import (
+    "fmt"
+    "image/color"
+    "net/http"
+    "testing"
+    "time"
+)
+
+// voteDeleted votes on a gif that was deleted after it was looked up, and
+// checks that the vote is refused and leaves nothing on the leaderboard.
+func voteDeleted(t *testing.T, s GroupStore) {
+    testServer(t, s)
+
+    group := &Group{Id: 1, Name: "group", Visibility: VisibilityPublic, CreatedAt: time.Now().UTC()}
+    gif := &Gif{Id: 1, GroupId: group.Id, CreatedAt: time.Now().UTC()}
+    err := store.SaveGroup(group)
+    if err == nil {
+        err = store.SaveGif(gif)
+    }
+    if err == nil {
+        err = store.DeleteGif(gif)
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = store.VoteGif(gif, 1, 1)
+    if appErr, ok := err.(*AppError); !ok || appErr.Code != ErrCodeNotFound {
+        t.Errorf("voting on a deleted gif got error %v, want not found", err)
+    }
+
+    leaders, err := store.FindGroupLeaderboard(group.Id, 10)
+    if err != nil || len(leaders) > 0 {
+        t.Errorf("leaderboard holds %v gifs, error %v, want none", len(leaders), err)
+    }
+    if r, ok := s.(*RedisStore); ok {
+        rC := r.pool.Get()
+        defer rC.Close()
+        n, err := rC.Do("EXISTS", "leaderboardForGroup:1", "votesForGif:1", "voteCountsForGif:1")
+        if err != nil || n != int64(0) {
+            t.Errorf("%v vote keys left behind, error %v", n, err)
+        }
+    }
+}
+
+func TestVoteDeletedMemory(t *testing.T) {
+    voteDeleted(t, NewMemoryStore())
+}
+
+func TestVoteDeletedRedis(t *testing.T) {
+    voteDeleted(t, testRedisStore(t))
+}
+
+// leadersPastHidden hides the best gifs of a group, and checks that the
+// leaderboard is filled with the next best for those who can't see them.
+func leadersPastHidden(t *testing.T, s GroupStore) {
+    testServer(t, s)
+
+    group := &Group{Id: 1, Name: "group", Visibility: VisibilityPublic, CreatedAt: time.Now().UTC()}
+    if err := store.SaveGroup(group); err != nil {
+        t.Fatal(err)
+    }
+    for i := 1; i <= 6; i++ {
+        gif := &Gif{Id: i, GroupId: group.Id, Hidden: i > 3, CreatedAt: time.Now().UTC()}
+        err := store.SaveGif(gif)
+        // Voters 1 to i vote the gif up, so the hidden gifs lead.
+        for voter := 1; err == nil && voter <= i; voter++ {
+            err = store.VoteGif(gif, voter, 1)
+        }
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    leaders, err := FindVisibleLeaders(nil, group, 2)
+    if err != nil || len(leaders) != 2 || leaders[0].Id != 3 || leaders[1].Id != 2 {
+        t.Errorf("got leaders %v, error %v, want gifs 3 and 2", leaders, err)
+    }
+    leaders, err = FindVisibleLeaders(nil, group, 5)
+    if err != nil || len(leaders) != 3 {
+        t.Errorf("got %v leaders, error %v, want the 3 visible gifs", len(leaders), err)
+    }
+    leaders, err = FindVisibleLeaders(&User{Id: 100, Role: RoleModerator}, group, 2)
+    if err != nil || len(leaders) != 2 || leaders[0].Id != 6 {
+        t.Errorf("moderator got leaders %v, error %v, want gif 6 first", leaders, err)
+    }
+}
+
+func TestLeadersPastHiddenMemory(t *testing.T) {
+    leadersPastHidden(t, NewMemoryStore())
+}
+
+func TestLeadersPastHiddenRedis(t *testing.T) {
+    leadersPastHidden(t, testRedisStore(t))
+}
+
+// voteCounts votes on a gif through the API, and checks that a user's vote
+// replaces the one they gave before, that withdrawing it takes it off the
+// counts, and that the leaderboard ranks the gif by them.
+func voteCounts(t *testing.T, s GroupStore) {
+    e, apiKey := testServer(t, s)
+    _, otherKey := testUser(t, RolePlayer)
+
+    groupId, err := postForm(e, apiKey, "/api/v1/groups", map[string]string{"name": "group"}, testGif(t, color.White))
+    if err != nil {
+        t.Fatal(err)
+    }
+    gifs := fmt.Sprintf("/api/v1/groups/%v/gifs", groupId)
+    var ids []int
+    for _, c := range []color.Color{color.Black, color.White} {
+        id, err := postForm(e, apiKey, gifs, nil, testGif(t, c))
+        if err != nil {
+            t.Fatal(err)
+        }
+        ids = append(ids, id)
+    }
+    path := fmt.Sprintf("/api/v1/gifs/%v/vote", ids[1])
+
+    tests := []struct {
+        name              string
+        method            string
+        apiKey            string
+        vote              string
+        code              int
+        upvotes, downvotes int
+    }{
+        {"voting up", "POST", apiKey, VoteUp, http.StatusOK, 1, 0},
+        {"voting down instead", "POST", apiKey, VoteDown, http.StatusOK, 0, 1},
+        {"another user voting up", "POST", otherKey, VoteUp, http.StatusOK, 1, 1},
+        {"withdrawing", "DELETE", apiKey, "", http.StatusOK, 1, 0},
+        {"voting sideways", "POST", apiKey, "sideways", http.StatusBadRequest, 1, 0},
+        {"voting anonymously", "POST", "", VoteUp, http.StatusUnauthorized, 1, 0},
+    }
+    for _, test := range tests {
+        if code := sendForm(t, e, test.method, test.apiKey, path, map[string]string{"vote": test.vote}, nil, nil); code != test.code {
+            t.Errorf("%v got %v, want %v", test.name, code, test.code)
+        }
+        var gif Gif
+        if code := getJSON(t, e, "", fmt.Sprintf("/api/v1/gifs/%v", ids[1]), &gif); code != http.StatusOK {
+            t.Fatalf("got %v", code)
+        }
+        if gif.Upvotes != test.upvotes || gif.Downvotes != test.downvotes {
+            t.Errorf("after %v got %v up and %v down, want %v and %v", test.name, gif.Upvotes, gif.Downvotes, test.upvotes, test.downvotes)
+        }
+    }
+
+    var leaders Gifs
+    if code := getJSON(t, e, "", fmt.Sprintf("/api/v1/groups/%v/leaderboard", groupId), &leaders); code != http.StatusOK || len(leaders) == 0 || leaders[0].Id != ids[1] {
+        t.Errorf("got %v and leaders %v, want gif %v first", code, leaders, ids[1])
+    }
+}
+
+func TestVoteCountsMemory(t *testing.T) {
+    voteCounts(t, NewMemoryStore())
+}
+
+func TestVoteCountsRedis(t *testing.T) {
+    voteCounts(t, testRedisStore(t))
+}